@@ -1,21 +1,133 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/rodweb/dns/internal/config"
+	msg "github.com/rodweb/dns/internal/message"
+	rsv "github.com/rodweb/dns/internal/resolver"
+	"github.com/rodweb/dns/internal/zone"
 	"log"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// shutdownTimeout is how long in flight requests may take once a shutdown signal is received
+const shutdownTimeout = 5 * time.Second
+
 func main() {
 	err := config.Load()
 	if err != nil {
 		log.Fatalln("Failed to load config:", err)
 	}
 
-	handler := NewHandler(config.Get().Records)
-	listener := NewListener(handler)
+	cfg := config.Get()
+	zoneRecords, err := loadZones(cfg.Zones)
+	if err != nil {
+		log.Fatalln("Failed to load zone:", err)
+	}
+	next, err := newUpstreamResolver(cfg)
+	if err != nil {
+		log.Fatalln("Failed to create resolver:", err)
+	}
+	handler, err := NewHandler(cfg.Records, zoneRecords, next, rsv.LocalOptions{
+		Order: rsv.RRsetOrder(cfg.RRsetOrder),
+	})
+	if err != nil {
+		log.Fatalln("Failed to load records:", err)
+	}
+	listener, err := NewListener(handler, cfg.Listen, cfg.MaxInFlight)
+	if err != nil {
+		log.Fatalln("Failed to create listener:", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- listener.ListenAndServe()
+	}()
 
-	err = listener.ListenAndServe()
+	select {
+	case err = <-errs:
+		if err != nil {
+			log.Fatalln("Failed to start listener:", err)
+		}
+		return
+	case <-ctx.Done():
+	}
+
+	// Stop reading new requests and give the in flight ones some time to finish
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = listener.Shutdown(shutdownCtx)
 	if err != nil {
-		log.Fatalln("Failed to start listener:", err)
+		log.Println("Failed to drain in flight requests:", err)
+	}
+}
+
+// loadZones reads the records of master files
+func loadZones(zones []*config.Zone) ([]*msg.Answer, error) {
+	var records []*msg.Answer
+	for _, z := range zones {
+		answers, err := zone.Load(z.File, z.Origin)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, answers...)
+		log.Printf("Loaded %d records from %s\n", len(answers), z.File)
+	}
+	return records, nil
+}
+
+// newUpstreamResolver creates the resolver for queries the local records do not answer:
+// forwarding to the upstreams if any, recursion from the root servers if enabled, or none.
+// Either one is cached unless the cache size is negative.
+func newUpstreamResolver(cfg config.Config) (rsv.Resolver, error) {
+	var next rsv.Resolver
+	switch {
+	case len(cfg.Upstreams) > 0:
+		forwardingResolver, err := rsv.NewForwardingResolver(cfg.Upstreams, rsv.ForwardingOptions{
+			Strategy:       rsv.Strategy(cfg.Strategy),
+			AttemptTimeout: time.Duration(cfg.UpstreamTimeout),
+			Retries:        cfg.UpstreamRetries,
+			RetryBackoff:   time.Duration(cfg.UpstreamRetryBackoff),
+			QueryTimeout:   time.Duration(cfg.QueryTimeout),
+			MixedCase:      cfg.MixedCase,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream resolver: %s", err)
+		}
+		next = forwardingResolver
+		log.Printf("Forwarding unanswered queries to %s\n", strings.Join(cfg.Upstreams, ", "))
+	case cfg.Recursive:
+		recursiveResolver, err := rsv.NewRecursiveResolver(rsv.RecursiveOptions{
+			AttemptTimeout: time.Duration(cfg.UpstreamTimeout),
+			QueryTimeout:   time.Duration(cfg.QueryTimeout),
+		})
+		if err != nil {
+			return nil, err
+		}
+		next = recursiveResolver
+		log.Println("Resolving unanswered queries recursively from the root servers")
+	default:
+		return nil, nil
+	}
+
+	if cfg.CacheSize < 0 {
+		return next, nil
 	}
+	return rsv.NewCachingResolver(next, rsv.CacheOptions{
+		Size:               cfg.CacheSize,
+		MinTTL:             time.Duration(cfg.CacheMinTTL),
+		MaxTTL:             time.Duration(cfg.CacheMaxTTL),
+		NegativeMaxTTL:     time.Duration(cfg.CacheNegativeMaxTTL),
+		PrefetchFraction:   cfg.CachePrefetch,
+		MaxStale:           time.Duration(cfg.CacheMaxStale),
+		StaleAnswerTimeout: time.Duration(cfg.CacheStaleAnswerTimeout),
+	}), nil
 }
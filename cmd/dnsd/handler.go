@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	cfg "github.com/rodweb/dns/internal/config"
 	msg "github.com/rodweb/dns/internal/message"
@@ -10,54 +13,97 @@ import (
 )
 
 type Resolver interface {
-	Resolve(request *msg.Message) (*msg.Message, error)
+	Resolve(ctx context.Context, request *msg.Message) (*msg.Message, error)
 }
 
+// errUnexpectedResponse is returned for packets that are responses rather than queries, which are never answered
+var errUnexpectedResponse = errors.New("unexpected response")
+
+// maxTCPMessageSize is the largest message the 2 byte TCP length prefix can describe
+const maxTCPMessageSize = 65535
+
 // Handler is a DNS query handler.
 type Handler struct {
-	dnsRecords map[string]*cfg.Record
-	resolver   Resolver
+	resolver Resolver
 }
 
-// NewHandler creates a new Handler.
-func NewHandler(records []*cfg.Record) *Handler {
-	dnsRecords := make(map[string]*cfg.Record)
-
-	// Map DNS records to be served by the DNS server
-	for _, r := range records {
-		key := fmt.Sprintf("%s:%s", r.Type, r.Name)
-		dnsRecords[key] = r
+// NewHandler creates a new Handler answering from the records of the config file and of zone files.
+// Queries not answered by the local records are passed to next, which may be nil.
+func NewHandler(records []*cfg.Record, zoneRecords []*msg.Answer, next rsv.Resolver, options rsv.LocalOptions) (*Handler, error) {
+	resolver, err := rsv.NewDefaultResolver(records, zoneRecords, next, options)
+	if err != nil {
+		return nil, err
 	}
 
-	resolver := rsv.NewDefaultResolver(dnsRecords)
-
-	log.Printf("Resolver initialized with %d DNS records\n", len(dnsRecords))
+	log.Printf("Resolver initialized with %d DNS records\n", len(records)+len(zoneRecords))
 
 	return &Handler{
-		dnsRecords: dnsRecords,
-		resolver:   resolver,
-	}
+		resolver: resolver,
+	}, nil
 }
 
-// Handle handles a DNS query.
-func (h *Handler) Handle(packet []byte) ([]byte, error) {
+// Handle handles a DNS query received over the given network ("udp" or "tcp").
+// Resolving stops when ctx is cancelled. Packets that must not be answered, such as responses,
+// return an error and no response.
+func (h *Handler) Handle(ctx context.Context, packet []byte, network string) ([]byte, error) {
 	printPacket(packet)
 
 	// Parse the DNS request
 	request, err := parseMessage(packet)
 	if err != nil {
 		log.Println("Failed to parse request:", err)
-		return nil, err
+		response := formatErrorResponse(packet)
+		if response == nil {
+			return nil, err
+		}
+		return response, nil
+	}
+	// Never answer responses, otherwise two servers could bounce them forever
+	if request.Header.IsResponse {
+		return nil, errUnexpectedResponse
+	}
+
+	// A request can carry at most one OPT record
+	if request.OPTCount() > 1 {
+		log.Println("Failed to parse request: multiple OPT records")
+		return formatErrorResponse(packet), nil
+	}
+	edns := request.EDNS()
+	if edns != nil && edns.Version > 0 {
+		return badVersionResponse(request).Bytes(), nil
 	}
 
 	// Resolve the DNS queries
-	response, err := h.resolver.Resolve(request)
+	response, err := h.resolver.Resolve(ctx, request)
 	if err != nil {
 		log.Println("Failed to resolve:", err)
 		return nil, err
 	}
 
-	return response.Bytes(), nil
+	// Only answer with EDNS(0) when the client used it
+	if edns != nil {
+		response.SetEDNS(&msg.EDNS{
+			UDPSize:  msg.DefaultUDPPayloadSize,
+			DNSSECOK: edns.DNSSECOK,
+		})
+	} else {
+		response.SetEDNS(nil)
+	}
+	// Responses that do not fit in a UDP payload are truncated,
+	// clients then retry over TCP where the 2 byte length prefix is the only limit
+	if network == "udp" {
+		response.Truncate(request.PayloadSize())
+	} else {
+		response.Truncate(maxTCPMessageSize)
+	}
+
+	data, err := response.Pack()
+	if err != nil {
+		// A local record with a name that does not fit the wire format
+		log.Println("Failed to encode response:", err)
+		return serverFailureResponse(request).Bytes(), nil
+	}
+	return data, nil
 }
 
 // printPacket pretty prints the UDP packet
@@ -76,6 +122,62 @@ func printPacket(packet []byte) {
 
 // parseMessage parses a DNS message.
 func parseMessage(packet []byte) (*msg.Message, error) {
-	// TODO: Handle errors without panicking
-	return msg.FromBytes(packet), nil
+	return msg.FromBytes(packet)
+}
+
+// serverFailureResponse builds a SERVFAIL response for a request whose answer cannot be sent
+func serverFailureResponse(request *msg.Message) *msg.Message {
+	return &msg.Message{
+		Header: &msg.Header{
+			ID:               request.Header.ID,
+			IsResponse:       true,
+			OperationCode:    request.Header.OperationCode,
+			RecursionDesired: request.Header.RecursionDesired,
+			ResponseCode:     msg.ServerFailure,
+		},
+		Questions: request.Questions,
+	}
+}
+
+// badVersionResponse builds a BADVERS response for a request using an EDNS version other than 0
+// https://www.rfc-editor.org/rfc/rfc6891#section-6.1.3
+func badVersionResponse(request *msg.Message) *msg.Message {
+	response := &msg.Message{
+		Header: &msg.Header{
+			ID:               request.Header.ID,
+			IsResponse:       true,
+			OperationCode:    request.Header.OperationCode,
+			RecursionDesired: request.Header.RecursionDesired,
+			ResponseCode:     msg.ResponseCode(msg.BadVersion & 0x0F),
+		},
+		Questions: request.Questions,
+	}
+	response.SetEDNS(&msg.EDNS{
+		UDPSize:              msg.DefaultUDPPayloadSize,
+		ExtendedResponseCode: uint8(msg.BadVersion >> 4),
+	})
+	return response
+}
+
+// formatErrorResponse builds a FORMERR response for a packet that failed to parse.
+// It returns nil when the packet is too short to carry an ID or is itself a response.
+func formatErrorResponse(packet []byte) []byte {
+	if len(packet) < 2 {
+		return nil
+	}
+	header := &msg.Header{
+		ID:           binary.BigEndian.Uint16(packet[0:2]),
+		IsResponse:   true,
+		ResponseCode: msg.FormatError,
+	}
+	if len(packet) >= 3 {
+		flags := packet[2]
+		// Never answer responses, otherwise two servers could bounce errors forever
+		if (flags>>7)&0x01 != 0 {
+			return nil
+		}
+		header.OperationCode = msg.OperationCode((flags >> 3) & 0x0F)
+		header.RecursionDesired = flags&0x01 != 0
+	}
+	return header.Bytes()
 }
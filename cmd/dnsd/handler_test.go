@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	msg "github.com/rodweb/dns/internal/message"
+	"strings"
+	"testing"
+)
+
+// countingResolver counts the requests it answers
+type countingResolver struct {
+	requests int
+}
+
+func (r *countingResolver) Resolve(ctx context.Context, request *msg.Message) (*msg.Message, error) {
+	r.requests++
+	return slowResolver{}.Resolve(ctx, request)
+}
+
+func TestHandleMalformed(t *testing.T) {
+	query := newTestQuery(0x1234)
+	query.Header.RecursionDesired = true
+	packet := query.Bytes()
+
+	tests := []struct {
+		name   string
+		packet []byte
+		// answered is false for packets dropped without a response
+		answered bool
+	}{
+		// The question is cut in the middle of its name
+		{"truncated question", packet[:15], true},
+		{"header only", packet[:5], true},
+		{"ID only", packet[:2], true},
+		{"shorter than an ID", packet[:1], false},
+		{"empty", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := &countingResolver{}
+			handler := &Handler{resolver: resolver}
+			data, err := handler.Handle(context.Background(), test.packet, "udp")
+			if resolver.requests != 0 {
+				t.Errorf("Expected the malformed packet not to be resolved")
+			}
+			if !test.answered {
+				if data != nil || err == nil {
+					t.Errorf("Expected the packet to be dropped with an error, got %v %v", data, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Failed to handle packet:", err)
+			}
+			response, err := msg.FromBytes(data)
+			if err != nil {
+				t.Fatal("Failed to parse response:", err)
+			}
+			if response.Header.ID != 0x1234 || !response.Header.IsResponse || response.Header.ResponseCode != msg.FormatError {
+				t.Errorf("Expected FORMERR with ID 0x1234, got %+v", response.Header)
+			}
+			if len(test.packet) > 2 && !response.Header.RecursionDesired {
+				t.Error("Expected RD to be copied from the query")
+			}
+		})
+	}
+}
+
+func TestHandleDropsResponses(t *testing.T) {
+	response := newTestQuery(1)
+	response.Header.IsResponse = true
+	packet := response.Bytes()
+
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"well formed", packet},
+		{"malformed", packet[:15]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := &countingResolver{}
+			handler := &Handler{resolver: resolver}
+			data, err := handler.Handle(context.Background(), test.packet, "udp")
+			if data != nil || err == nil {
+				t.Errorf("Expected the response to be dropped with an error, got %v %v", data, err)
+			}
+			if resolver.requests != 0 {
+				t.Errorf("Expected the response not to be resolved")
+			}
+		})
+	}
+
+	// The same packet as a query is answered
+	resolver := &countingResolver{}
+	handler := &Handler{resolver: resolver}
+	data, err := handler.Handle(context.Background(), newTestQuery(1).Bytes(), "udp")
+	if err != nil || data == nil || resolver.requests != 1 {
+		t.Errorf("Expected the query to be answered, got %v %v", data, err)
+	}
+}
+
+// invalidNameResolver answers with a CNAME whose target does not fit the wire format
+type invalidNameResolver struct{}
+
+func (invalidNameResolver) Resolve(ctx context.Context, request *msg.Message) (*msg.Message, error) {
+	response, _ := slowResolver{}.Resolve(ctx, request)
+	response.Answers = []*msg.Answer{{
+		Name:  request.Questions[0].Name,
+		Type:  msg.TypeCNAME,
+		Class: msg.ClassINET,
+		TTL:   60,
+		Data:  &msg.CNAME{Target: strings.Repeat("a", 200) + ".test"},
+	}}
+	return response, nil
+}
+
+func TestHandleUnencodableResponse(t *testing.T) {
+	handler := &Handler{resolver: invalidNameResolver{}}
+	data, err := handler.Handle(context.Background(), newTestQuery(1).Bytes(), "udp")
+	if err != nil {
+		t.Fatal("Failed to handle packet:", err)
+	}
+	response, err := msg.FromBytes(data)
+	if err != nil {
+		t.Fatal("Failed to parse response:", err)
+	}
+	if response.Header.ID != 1 || response.Header.ResponseCode != msg.ServerFailure || len(response.Answers) != 0 {
+		t.Errorf("Expected SERVFAIL without answers, got %+v %v", response.Header, response.Answers)
+	}
+}
@@ -1,61 +1,432 @@
 package main
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	msg "github.com/rodweb/dns/internal/message"
+	"io"
 	"log"
 	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
-// Listener listens for DNS requests
+const (
+	// tcpIdleTimeout is how long a TCP connection may stay open without a new query
+	// https://www.rfc-editor.org/rfc/rfc7766#section-6.2.3
+	tcpIdleTimeout = 10 * time.Second
+	// tcpMaxConnections is the number of TCP connections served at the same time
+	tcpMaxConnections = 128
+	// tcpWriteTimeout is how long a response may wait for the client to make room for it,
+	// after which the connection is closed
+	tcpWriteTimeout = 5 * time.Second
+	// tcpMaxPipelined is the number of queries of a single TCP connection handled at the same time
+	tcpMaxPipelined = 8
+)
+
+// Listener listens for DNS requests on one or more UDP and TCP sockets
 type Listener struct {
-	handler *Handler
-	udpAddr *net.UDPAddr
+	handler   *Handler
+	addresses []listenAddress
+	// tcpSlots limits the number of TCP connections open across all sockets
+	tcpSlots chan struct{}
+	// idleTimeout is how long a TCP connection may wait for its next query
+	idleTimeout time.Duration
+	// writeTimeout is how long a TCP response may take to be written
+	writeTimeout time.Duration
+	// maxPipelined is the number of queries a TCP connection may have in flight,
+	// so that a single client cannot take every inFlight slot
+	maxPipelined int
+	// inFlight limits the number of requests handled at the same time across all sockets.
+	// When it is full sockets stop reading, so clients see backpressure instead of an
+	// unbounded number of goroutines.
+	inFlight chan struct{}
+	// buffers holds reusable UDP receive buffers
+	buffers sync.Pool
+	// ctx is passed to every request, it is cancelled when shutdown runs out of time
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex   sync.Mutex
+	closed  bool
+	sockets []io.Closer
+	// conns holds the open TCP connections, so shutdown can stop them from reading
+	conns map[*net.TCPConn]struct{}
 }
 
-// NewListener creates a new Listener
-func NewListener(handler *Handler) *Listener {
-	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:2053")
-	if err != nil {
-		log.Fatalln("Failed to resolve UDP address:", err)
+// listenAddress is an address to serve on with a single protocol
+type listenAddress struct {
+	// network is "udp" or "tcp"
+	network string
+	address string
+}
+
+// NewListener creates a new Listener for the given addresses.
+// Addresses are "udp://ip:port", "tcp://ip:port" or "ip:port" to serve both protocols.
+// At most maxInFlight requests are handled concurrently.
+func NewListener(handler *Handler, addresses []string, maxInFlight int) (*Listener, error) {
+	var listenAddresses []listenAddress
+	for _, address := range addresses {
+		parsed, err := parseListenAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		listenAddresses = append(listenAddresses, parsed...)
+	}
+	if len(listenAddresses) == 0 {
+		return nil, fmt.Errorf("no listen address")
+	}
+	if maxInFlight < 1 {
+		return nil, fmt.Errorf("invalid max in flight requests %d", maxInFlight)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Listener{
-		handler: handler,
-		udpAddr: udpAddr,
+		handler:      handler,
+		addresses:    listenAddresses,
+		tcpSlots:     make(chan struct{}, tcpMaxConnections),
+		idleTimeout:  tcpIdleTimeout,
+		writeTimeout: tcpWriteTimeout,
+		maxPipelined: tcpMaxPipelined,
+		inFlight:     make(chan struct{}, maxInFlight),
+		buffers: sync.Pool{
+			New: func() any {
+				// Requests are small, but clients may still send up to the size we advertise
+				buffer := make([]byte, msg.DefaultUDPPayloadSize)
+				return &buffer
+			},
+		},
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  make(map[*net.TCPConn]struct{}),
+	}, nil
+}
+
+// parseListenAddress parses an address with an optional protocol scheme
+func parseListenAddress(value string) ([]listenAddress, error) {
+	networks := []string{"udp", "tcp"}
+	address := value
+	if scheme, rest, found := strings.Cut(value, "://"); found {
+		if scheme != "udp" && scheme != "tcp" {
+			return nil, fmt.Errorf("invalid listen address %q: unknown protocol %q", value, scheme)
+		}
+		networks = []string{scheme}
+		address = rest
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %s", value, err)
 	}
+
+	result := make([]listenAddress, len(networks))
+	for i, network := range networks {
+		result[i] = listenAddress{network: network, address: address}
+	}
+	return result, nil
 }
 
-// ListenAndServe starts the Listener
+// ListenAndServe binds every address and serves them until one of them fails or Close is called.
+// All sockets are closed together.
 func (l *Listener) ListenAndServe() error {
-	udpConn, err := net.ListenUDP("udp", l.udpAddr)
-	if err != nil {
-		log.Fatalln("Failed to bind to address:", err)
+	var serves []func() error
+	for _, address := range l.addresses {
+		serve, err := l.listen(address)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		log.Printf("Listening on %s://%s\n", address.network, address.address)
+		serves = append(serves, serve)
 	}
-	defer func() {
-		err := udpConn.Close()
+
+	errs := make(chan error, len(serves))
+	for _, serve := range serves {
+		go func(serve func() error) {
+			errs <- serve()
+		}(serve)
+	}
+
+	// The first socket to stop brings the others down,
+	// unless they are already stopping because of Shutdown
+	err := <-errs
+	if !l.isClosed() {
+		l.Close()
+	}
+	for i := 1; i < len(serves); i++ {
+		<-errs
+	}
+	return err
+}
+
+// Close closes every socket of the Listener, requests being handled are not waited for
+func (l *Listener) Close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.closed = true
+	for _, socket := range l.sockets {
+		err := socket.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Println("Failed to close socket:", err)
+		}
+	}
+	l.sockets = nil
+}
+
+// Shutdown stops reading new requests and waits for the requests being handled to finish,
+// then closes every socket. When ctx is done first, the remaining requests are cancelled
+// and ctx's error is returned.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	defer l.Close()
+	l.stopReading()
+
+	// Once every in flight slot is taken no request is being handled
+	for i := 0; i < cap(l.inFlight); i++ {
+		select {
+		case l.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			l.cancel()
+			return ctx.Err()
+		}
+	}
+	l.cancel()
+	return nil
+}
+
+// stopReading makes every socket and TCP connection stop waiting for requests.
+// UDP sockets stay open, in flight requests still need them to send their response.
+func (l *Listener) stopReading() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.closed = true
+	for _, socket := range l.sockets {
+		var err error
+		switch socket := socket.(type) {
+		case *net.UDPConn:
+			err = socket.SetReadDeadline(time.Now())
+		default:
+			err = socket.Close()
+		}
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Println("Failed to stop socket:", err)
+		}
+	}
+	for conn := range l.conns {
+		err := conn.SetReadDeadline(time.Now())
 		if err != nil {
-			log.Println("Failed to close UDP connection:", err)
+			log.Println("Failed to set read deadline:", err)
 		}
-	}()
+	}
+}
+
+func (l *Listener) isClosed() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.closed
+}
 
-	buffer := make([]byte, 512)
+// listen binds an address and returns the loop serving it
+func (l *Listener) listen(address listenAddress) (func() error, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 
+	switch address.network {
+	case "udp":
+		udpAddr, err := net.ResolveUDPAddr("udp", address.address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve UDP address: %s", err)
+		}
+		udpConn, err := net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to bind to address: %s", err)
+		}
+		l.sockets = append(l.sockets, udpConn)
+		return func() error { return l.serveUDP(udpConn) }, nil
+	default:
+		tcpAddr, err := net.ResolveTCPAddr("tcp", address.address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve TCP address: %s", err)
+		}
+		tcpListener, err := net.ListenTCP("tcp", tcpAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to bind to address: %s", err)
+		}
+		l.sockets = append(l.sockets, tcpListener)
+		return func() error { return l.serveTCP(tcpListener) }, nil
+	}
+}
+
+// serveUDP reads datagrams and handles each one in its own goroutine,
+// so a slow upstream lookup does not hold back other clients
+func (l *Listener) serveUDP(udpConn *net.UDPConn) error {
 	for {
-		size, source, err := udpConn.ReadFromUDP(buffer)
+		buffer := l.buffers.Get().(*[]byte)
+
+		size, source, err := udpConn.ReadFromUDP(*buffer)
 		if err != nil {
+			l.buffers.Put(buffer)
+			if errors.Is(err, net.ErrClosed) || l.isClosed() {
+				return nil
+			}
 			log.Println("Error receiving data:", err)
 			continue
 		}
 
-		response, err := l.handler.Handle(buffer[:size])
+		// Waiting for a slot before the next read is what makes a busy Listener stop reading,
+		// waiting for a packet holds no slot. Once shutdown took every slot the packet is dropped.
+		select {
+		case l.inFlight <- struct{}{}:
+		case <-l.ctx.Done():
+			l.buffers.Put(buffer)
+			return nil
+		}
+		go func() {
+			defer func() {
+				l.buffers.Put(buffer)
+				<-l.inFlight
+			}()
+
+			response, err := l.handler.Handle(l.ctx, (*buffer)[:size], "udp")
+			if err != nil {
+				log.Println("Failed to handle packet:", err)
+				return
+			}
+
+			_, err = udpConn.WriteToUDP(response, source)
+			if err != nil {
+				log.Println("Failed to send response:", err)
+			}
+		}()
+	}
+}
+
+func (l *Listener) serveTCP(tcpListener *net.TCPListener) error {
+	for {
+		// Limit the number of open connections, new ones wait to be accepted
+		l.tcpSlots <- struct{}{}
+		conn, err := tcpListener.AcceptTCP()
 		if err != nil {
-			log.Println("Failed to handle packet:", err)
+			<-l.tcpSlots
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Println("Error accepting connection:", err)
 			continue
 		}
 
-		_, err = udpConn.WriteToUDP(response, source)
+		go func() {
+			defer func() { <-l.tcpSlots }()
+			l.serveTCPConn(conn)
+		}()
+	}
+}
+
+// serveTCPConn reads length prefixed queries from a connection until it is idle or closed.
+// Queries are pipelined: each one is handled concurrently and answered as soon as it is ready.
+// A client that does not read its responses in time gets its connection closed.
+// https://www.rfc-editor.org/rfc/rfc7766#section-6.2.1.1
+func (l *Listener) serveTCPConn(conn *net.TCPConn) {
+	var wg sync.WaitGroup
+	var writeMutex sync.Mutex
+	// pipelined limits the queries of the connection being handled, reading stops when it is full
+	pipelined := make(chan struct{}, l.maxPipelined)
+	l.mutex.Lock()
+	l.conns[conn] = struct{}{}
+	l.mutex.Unlock()
+	defer func() {
+		wg.Wait()
+		l.mutex.Lock()
+		delete(l.conns, conn)
+		l.mutex.Unlock()
+		err := conn.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Println("Failed to close TCP connection:", err)
+		}
+	}()
+
+	for {
+		if !l.extendReadDeadline(conn) {
+			return
+		}
+		packet, err := readTCPMessage(conn)
 		if err != nil {
-			log.Println("Failed to send response:", err)
-			continue
+			// Clients closing the connection or staying idle are expected
+			if err != io.EOF && !errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Println("Error receiving data:", err)
+			}
+			return
 		}
+
+		pipelined <- struct{}{}
+		l.inFlight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-l.inFlight
+				<-pipelined
+				wg.Done()
+			}()
+			response, err := l.handler.Handle(l.ctx, packet, "tcp")
+			if err != nil {
+				log.Println("Failed to handle packet:", err)
+				return
+			}
+
+			writeMutex.Lock()
+			defer writeMutex.Unlock()
+			err = conn.SetWriteDeadline(time.Now().Add(l.writeTimeout))
+			if err == nil {
+				err = writeTCPMessage(conn, response)
+			}
+			if err != nil {
+				// The client is gone or does not read, its other responses would block as well
+				if !errors.Is(err, net.ErrClosed) {
+					log.Println("Failed to send response:", err)
+				}
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// extendReadDeadline lets a connection wait for another query unless the Listener is closed
+func (l *Listener) extendReadDeadline(conn *net.TCPConn) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return false
+	}
+	err := conn.SetReadDeadline(time.Now().Add(l.idleTimeout))
+	if err != nil {
+		log.Println("Failed to set read deadline:", err)
+		return false
 	}
+	return true
+}
+
+// readTCPMessage reads a message prefixed by its 2 byte length
+// https://www.rfc-editor.org/rfc/rfc1035#section-4.2.2
+func readTCPMessage(conn net.Conn) ([]byte, error) {
+	var length uint16
+	err := binary.Read(conn, binary.BigEndian, &length)
+	if err != nil {
+		return nil, err
+	}
+	packet := make([]byte, length)
+	_, err = io.ReadFull(conn, packet)
+	if err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// writeTCPMessage writes a message prefixed by its 2 byte length, in a single write
+func writeTCPMessage(conn net.Conn, packet []byte) error {
+	data := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(data[0:2], uint16(len(packet)))
+	copy(data[2:], packet)
+	_, err := conn.Write(data)
+	return err
 }
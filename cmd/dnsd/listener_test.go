@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	msg "github.com/rodweb/dns/internal/message"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowResolver answers every request after a delay, like a forwarded lookup would
+type slowResolver struct {
+	delay time.Duration
+}
+
+func (r slowResolver) Resolve(ctx context.Context, request *msg.Message) (*msg.Message, error) {
+	select {
+	case <-time.After(r.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &msg.Message{
+		Header: &msg.Header{
+			ID:         request.Header.ID,
+			IsResponse: true,
+		},
+		Questions: request.Questions,
+	}, nil
+}
+
+// startListener serves a Listener with a resolver on a random local port of a single protocol address.
+// configure, when not nil, can change the Listener before it starts serving.
+func startListener(t testing.TB, resolver Resolver, address string, maxInFlight int, configure func(*Listener)) (*Listener, net.Addr) {
+	listener, addrs := startListeners(t, resolver, []string{address}, maxInFlight, configure)
+	return listener, addrs[0]
+}
+
+// startListeners serves a Listener on single protocol addresses, returning the address bound for each
+func startListeners(t testing.TB, resolver Resolver, addresses []string, maxInFlight int, configure func(*Listener)) (*Listener, []net.Addr) {
+	listener, err := NewListener(&Handler{resolver: resolver}, addresses, maxInFlight)
+	if err != nil {
+		t.Fatal("Failed to create listener:", err)
+	}
+	if configure != nil {
+		configure(listener)
+	}
+	t.Cleanup(listener.Close)
+	var addrs []net.Addr
+	for i, address := range listener.addresses {
+		serve, err := listener.listen(address)
+		if err != nil {
+			t.Fatal("Failed to bind:", err)
+		}
+		go serve()
+		switch socket := listener.sockets[i].(type) {
+		case *net.UDPConn:
+			addrs = append(addrs, socket.LocalAddr())
+		default:
+			addrs = append(addrs, socket.(*net.TCPListener).Addr())
+		}
+	}
+	return listener, addrs
+}
+
+// startUDPListener serves a Listener with a slow resolver on a random local port
+func startUDPListener(t testing.TB, delay time.Duration, maxInFlight int) (*Listener, *net.UDPAddr) {
+	listener, addr := startListener(t, slowResolver{delay: delay}, "udp://127.0.0.1:0", maxInFlight, nil)
+	return listener, addr.(*net.UDPAddr)
+}
+
+func newTestQuery(id uint16) *msg.Message {
+	return &msg.Message{
+		Header:    &msg.Header{ID: id},
+		Questions: []*msg.Question{{Name: "abc.com", Type: msg.TypeA, Class: msg.ClassINET}},
+	}
+}
+
+// exchange sends a query and waits for its response
+func exchange(t testing.TB, addr *net.UDPAddr, id uint16) {
+	query := newTestQuery(id)
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Error("Failed to dial:", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(query.Bytes()); err != nil {
+		t.Error("Failed to send query:", err)
+		return
+	}
+	buffer := make([]byte, msg.DefaultUDPPayloadSize)
+	if _, err := conn.Read(buffer); err != nil {
+		t.Error("Failed to receive response:", err)
+	}
+}
+
+func TestParseListenAddress(t *testing.T) {
+	tests := []struct {
+		value     string
+		addresses []listenAddress
+		fails     bool
+	}{
+		{"127.0.0.1:53", []listenAddress{{"udp", "127.0.0.1:53"}, {"tcp", "127.0.0.1:53"}}, false},
+		{"udp://127.0.0.1:53", []listenAddress{{"udp", "127.0.0.1:53"}}, false},
+		{"tcp://0.0.0.0:5353", []listenAddress{{"tcp", "0.0.0.0:5353"}}, false},
+		{"[::]:53", []listenAddress{{"udp", "[::]:53"}, {"tcp", "[::]:53"}}, false},
+		{"tcp://[::1]:53", []listenAddress{{"tcp", "[::1]:53"}}, false},
+		{":53", []listenAddress{{"udp", ":53"}, {"tcp", ":53"}}, false},
+		{"", nil, true},
+		{"127.0.0.1", nil, true},
+		// IPv6 addresses need brackets to tell the port apart
+		{"::1:53", nil, true},
+		{"http://127.0.0.1:53", nil, true},
+		{"UDP://127.0.0.1:53", nil, true},
+		{"udp://", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			addresses, err := parseListenAddress(test.value)
+			if test.fails {
+				if err == nil {
+					t.Errorf("Expected %q to fail, got %v", test.value, addresses)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Failed to parse:", err)
+			}
+			if len(addresses) != len(test.addresses) {
+				t.Fatalf("Expected %v, got %v", test.addresses, addresses)
+			}
+			for i, address := range addresses {
+				if address != test.addresses[i] {
+					t.Errorf("Expected %v, got %v", test.addresses, addresses)
+				}
+			}
+		})
+	}
+}
+
+func TestNewListenerAddresses(t *testing.T) {
+	listener, err := NewListener(&Handler{}, []string{"udp://127.0.0.1:53", "[::1]:53"}, 1)
+	if err != nil {
+		t.Fatal("Failed to create listener:", err)
+	}
+	expected := []listenAddress{{"udp", "127.0.0.1:53"}, {"udp", "[::1]:53"}, {"tcp", "[::1]:53"}}
+	if len(listener.addresses) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, listener.addresses)
+	}
+	for i, address := range listener.addresses {
+		if address != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, listener.addresses)
+		}
+	}
+
+	if _, err := NewListener(&Handler{}, nil, 1); err == nil {
+		t.Error("Expected no address to fail")
+	}
+	if _, err := NewListener(&Handler{}, []string{"127.0.0.1:53", "bad"}, 1); err == nil {
+		t.Error("Expected a bad address among good ones to fail")
+	}
+}
+
+func TestServeUDPConcurrently(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	const queries = 10
+	_, addr := startUDPListener(t, delay, queries)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			exchange(t, addr, id)
+		}(uint16(i))
+	}
+	wg.Wait()
+
+	// Serialized handling would take queries * delay
+	if elapsed := time.Since(start); elapsed > queries*delay/2 {
+		t.Errorf("Expected concurrent handling, %d queries took %s", queries, elapsed)
+	}
+}
+
+func TestServeUDPIdleHoldsNoSlot(t *testing.T) {
+	// A single slot shared by a UDP socket waiting for packets and a TCP connection
+	_, addrs := startListeners(t, slowResolver{}, []string{"udp://127.0.0.1:0", "tcp://127.0.0.1:0"}, 1, nil)
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	if response := exchangeTCP(t, dialTCP(t, addrs[1]), 1); response.Header.ID != 1 {
+		t.Errorf("Expected a response with ID 1, got %d", response.Header.ID)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the TCP query to be answered without UDP traffic, took %s", elapsed)
+	}
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	listener, addr := startUDPListener(t, delay, 4)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		exchange(t, addr, 1)
+	}()
+	time.Sleep(delay / 4)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := listener.Shutdown(ctx); err != nil {
+		t.Fatal("Failed to shutdown:", err)
+	}
+	if elapsed := time.Since(start); elapsed < delay/2 {
+		t.Errorf("Expected shutdown to wait for the in flight request, it took %s", elapsed)
+	}
+	// exchange fails the test if the response never arrives
+	<-done
+}
+
+func TestShutdownCancelsAfterDeadline(t *testing.T) {
+	listener, addr := startUDPListener(t, time.Minute, 4)
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal("Failed to dial:", err)
+	}
+	defer conn.Close()
+	query := &msg.Message{Header: &msg.Header{ID: 1}}
+	if _, err := conn.Write(query.Bytes()); err != nil {
+		t.Fatal("Failed to send query:", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := listener.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if listener.ctx.Err() == nil {
+		t.Error("Expected in flight requests to be cancelled")
+	}
+}
+
+// largeAnswers is the number of records answered by largeResolver
+const largeAnswers = 64
+
+// largeResolver answers every request with more A records than fit in 512 bytes
+type largeResolver struct{}
+
+func (largeResolver) Resolve(ctx context.Context, request *msg.Message) (*msg.Message, error) {
+	response := &msg.Message{
+		Header: &msg.Header{
+			ID:         request.Header.ID,
+			IsResponse: true,
+		},
+		Questions: request.Questions,
+	}
+	for i := 0; i < largeAnswers; i++ {
+		response.Answers = append(response.Answers, &msg.Answer{
+			Name:  request.Questions[0].Name,
+			Type:  msg.TypeA,
+			Class: msg.ClassINET,
+			TTL:   60,
+			Data:  &msg.A{IP: net.IPv4(10, 0, 0, byte(i))},
+		})
+	}
+	return response, nil
+}
+
+// dialTCP connects to a TCP listener, reads and writes fail after 5 seconds
+func dialTCP(t *testing.T, addr net.Addr) net.Conn {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal("Failed to dial:", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// readTCPResponse reads a length prefixed response
+func readTCPResponse(t *testing.T, conn net.Conn) *msg.Message {
+	packet, err := readTCPMessage(conn)
+	if err != nil {
+		t.Fatal("Failed to receive response:", err)
+	}
+	response, err := msg.FromBytes(packet)
+	if err != nil {
+		t.Fatal("Failed to parse response:", err)
+	}
+	return response
+}
+
+// exchangeTCP sends a query over a connection and waits for its response
+func exchangeTCP(t *testing.T, conn net.Conn, id uint16) *msg.Message {
+	if err := writeTCPMessage(conn, newTestQuery(id).Bytes()); err != nil {
+		t.Fatal("Failed to send query:", err)
+	}
+	return readTCPResponse(t, conn)
+}
+
+func TestServeTCPFraming(t *testing.T) {
+	_, addr := startListener(t, slowResolver{}, "tcp://127.0.0.1:0", 4, nil)
+	conn := dialTCP(t, addr)
+
+	packet := newTestQuery(7).Bytes()
+	framed := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(framed, uint16(len(packet)))
+	copy(framed[2:], packet)
+	// The length and the message may arrive split across segments
+	for _, part := range [][]byte{framed[:1], framed[1:5], framed[5:]} {
+		if _, err := conn.Write(part); err != nil {
+			t.Fatal("Failed to send query:", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		t.Fatal("Failed to receive length:", err)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal("Failed to receive response:", err)
+	}
+	response, err := msg.FromBytes(data)
+	if err != nil {
+		t.Fatal("Expected the length to frame exactly one message:", err)
+	}
+	if response.Header.ID != 7 || !response.Header.IsResponse {
+		t.Errorf("Expected a response with ID 7, got %+v", response.Header)
+	}
+}
+
+func TestServeTCPPipelining(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	const queries = 5
+	_, addr := startListener(t, slowResolver{delay: delay}, "tcp://127.0.0.1:0", queries, nil)
+	conn := dialTCP(t, addr)
+
+	// Every query is sent before reading any response
+	start := time.Now()
+	for id := uint16(1); id <= queries; id++ {
+		if err := writeTCPMessage(conn, newTestQuery(id).Bytes()); err != nil {
+			t.Fatal("Failed to send query:", err)
+		}
+	}
+	ids := make(map[uint16]bool)
+	for i := 0; i < queries; i++ {
+		ids[readTCPResponse(t, conn).Header.ID] = true
+	}
+
+	if len(ids) != queries {
+		t.Errorf("Expected a response to each of the %d queries, got %v", queries, ids)
+	}
+	// Serialized handling would take queries * delay
+	if elapsed := time.Since(start); elapsed > queries*delay/2 {
+		t.Errorf("Expected concurrent handling, %d queries took %s", queries, elapsed)
+	}
+}
+
+func TestServeTCPIdleTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	_, addr := startListener(t, slowResolver{}, "tcp://127.0.0.1:0", 4, func(l *Listener) {
+		l.idleTimeout = timeout
+	})
+	conn := dialTCP(t, addr)
+	exchangeTCP(t, conn, 1)
+
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the server to close the idle connection, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout/2 || elapsed > 2*time.Second {
+		t.Errorf("Expected the connection to be closed after %s, took %s", timeout, elapsed)
+	}
+}
+
+func TestServeTCPConnectionLimit(t *testing.T) {
+	_, addr := startListener(t, slowResolver{}, "tcp://127.0.0.1:0", 4, func(l *Listener) {
+		l.tcpSlots = make(chan struct{}, 1)
+	})
+	first := dialTCP(t, addr)
+	exchangeTCP(t, first, 1)
+
+	// The second connection waits to be accepted while the first one is open
+	second := dialTCP(t, addr)
+	if err := writeTCPMessage(second, newTestQuery(2).Bytes()); err != nil {
+		t.Fatal("Failed to send query:", err)
+	}
+	second.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := readTCPMessage(second); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected no response over the limit, got %v", err)
+	}
+
+	first.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if response := readTCPResponse(t, second); response.Header.ID != 2 {
+		t.Errorf("Expected a response with ID 2 once a slot is free, got %d", response.Header.ID)
+	}
+}
+
+func TestTruncatedOnlyOverUDP(t *testing.T) {
+	_, udpAddr := startListener(t, largeResolver{}, "udp://127.0.0.1:0", 4, nil)
+	_, tcpAddr := startListener(t, largeResolver{}, "tcp://127.0.0.1:0", 4, nil)
+
+	conn, err := net.DialUDP("udp", nil, udpAddr.(*net.UDPAddr))
+	if err != nil {
+		t.Fatal("Failed to dial:", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(newTestQuery(1).Bytes()); err != nil {
+		t.Fatal("Failed to send query:", err)
+	}
+	buffer := make([]byte, msg.DefaultUDPPayloadSize)
+	size, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatal("Failed to receive response:", err)
+	}
+	response, err := msg.FromBytes(buffer[:size])
+	if err != nil {
+		t.Fatal("Failed to parse response:", err)
+	}
+	// Without EDNS the client only accepts 512 bytes over UDP
+	if !response.Header.Truncated || size > 512 || len(response.Answers) == largeAnswers {
+		t.Errorf("Expected a truncated UDP response, got TC %t with %d answers in %d bytes", response.Header.Truncated, len(response.Answers), size)
+	}
+
+	response = exchangeTCP(t, dialTCP(t, tcpAddr), 1)
+	if response.Header.Truncated || len(response.Answers) != largeAnswers {
+		t.Errorf("Expected the full TCP response, got TC %t with %d answers", response.Header.Truncated, len(response.Answers))
+	}
+}
+
+// hogTCP pipelines large queries over a connection that never reads its responses
+func hogTCP(t *testing.T, addr net.Addr) {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal("Failed to dial:", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	// A small receive window fills up after a few responses
+	conn.(*net.TCPConn).SetReadBuffer(1024)
+	go func() {
+		for id := uint16(0); id < 20000; id++ {
+			if writeTCPMessage(conn, newTestQuery(id).Bytes()) != nil {
+				return
+			}
+		}
+	}()
+	// Let the responses back up
+	time.Sleep(300 * time.Millisecond)
+}
+
+func TestServeTCPSlowReader(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(l *Listener)
+	}{
+		// The connection cannot take more than its share of the in flight slots
+		{"pipelining limit", func(l *Listener) {
+			l.maxPipelined = 2
+			l.writeTimeout = time.Minute
+		}},
+		// The connection takes every slot until its responses time out
+		{"write timeout", func(l *Listener) {
+			l.maxPipelined = 4
+			l.writeTimeout = 200 * time.Millisecond
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, addrs := startListeners(t, largeResolver{}, []string{"udp://127.0.0.1:0", "tcp://127.0.0.1:0"}, 4, test.configure)
+			hogTCP(t, addrs[1])
+
+			// exchange fails the test if the response never arrives
+			start := time.Now()
+			for id := uint16(1); id <= 2; id++ {
+				exchange(t, addrs[0].(*net.UDPAddr), id)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("Expected the UDP client to be served, took %s", elapsed)
+			}
+		})
+	}
+}
+
+func BenchmarkServeUDPSlowUpstream(b *testing.B) {
+	_, addr := startUDPListener(b, 5*time.Millisecond, 256)
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for id := uint16(0); pb.Next(); id++ {
+			exchange(b, addr, id)
+		}
+	})
+}
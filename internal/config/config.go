@@ -6,15 +6,96 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultListen is the address served when none is configured, on both UDP and TCP
+	DefaultListen = "127.0.0.1:2053"
+	// DefaultMaxInFlight is the number of requests handled concurrently when none is configured
+	DefaultMaxInFlight = 256
 )
 
 type cliOptions struct {
-	Resolver string
-	Config   string
+	Config string
 }
 
 type fileOptions struct {
-	Records []*Record `json:"records"`
+	// Listen holds the addresses to serve on, as "udp://ip:port", "tcp://ip:port"
+	// or "ip:port" for both protocols. IPv6 addresses go in brackets: "[::]:53"
+	Listen []string `json:"listen"`
+	// MaxInFlight is the number of requests handled concurrently before sockets stop reading
+	MaxInFlight int `json:"maxInFlight"`
+	// Upstreams holds the ip:port of the resolvers queries are forwarded to
+	Upstreams []string `json:"upstreams"`
+	// Recursive resolves queries from the root servers when no upstream is configured
+	Recursive bool `json:"recursive"`
+	// Strategy picks the upstream tried first: sequential, random, round-robin or fastest
+	Strategy string `json:"strategy"`
+	// UpstreamTimeout is how long a single upstream may take to answer, such as "2s"
+	UpstreamTimeout Duration `json:"upstreamTimeout"`
+	// UpstreamRetries is the number of extra rounds over all upstreams once they all failed
+	UpstreamRetries int `json:"upstreamRetries"`
+	// UpstreamRetryBackoff is the wait before the first retry round, doubled for every following one
+	UpstreamRetryBackoff Duration `json:"upstreamRetryBackoff"`
+	// QueryTimeout is the time budget of a forwarded query before answering SERVFAIL
+	QueryTimeout Duration `json:"queryTimeout"`
+	// MixedCase randomizes the case of forwarded names (0x20 encoding) as a defence against spoofing
+	MixedCase bool `json:"mixedCase"`
+	// CacheSize is the number of forwarded responses cached, a negative size disables the cache
+	CacheSize int `json:"cacheSize"`
+	// CacheMinTTL raises the TTL of cached records that would expire sooner, such as "30s"
+	CacheMinTTL Duration `json:"cacheMinTTL"`
+	// CacheMaxTTL lowers the TTL of cached records that would be kept longer, such as "1h"
+	CacheMaxTTL Duration `json:"cacheMaxTTL"`
+	// CacheNegativeMaxTTL caps how long names and types that do not exist are cached, such as "5m"
+	CacheNegativeMaxTTL Duration `json:"cacheNegativeMaxTTL"`
+	// CachePrefetch is the fraction of their TTL after which queried entries are refreshed, such as 0.9.
+	// A negative fraction disables prefetching
+	CachePrefetch float64 `json:"cachePrefetch"`
+	// CacheMaxStale is how long expired entries are served when every upstream fails or is slow, such as "24h".
+	// A negative duration disables serving stale data
+	CacheMaxStale Duration `json:"cacheMaxStale"`
+	// CacheStaleAnswerTimeout is how long a refresh may take before expired entries are served, such as "1.8s".
+	// A negative duration waits for every upstream to fail
+	CacheStaleAnswerTimeout Duration  `json:"cacheStaleAnswerTimeout"`
+	Records                 []*Record `json:"records"`
+	// RRsetOrder is the order records of the same name and type are answered in: fixed, cyclic or random
+	RRsetOrder string `json:"rrsetOrder"`
+	// Zones holds master files whose records are served along with Records
+	Zones []*Zone `json:"zones"`
+}
+
+// Duration is a time.Duration read from a JSON string such as "500ms"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// listFlag is a flag that can be repeated or hold comma separated values
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		*f = append(*f, strings.TrimSpace(item))
+	}
+	return nil
 }
 
 type Record struct {
@@ -25,6 +106,14 @@ type Record struct {
 	Note  string `json:"note,omitempty"`
 }
 
+// Zone is a master (BIND zone) file
+type Zone struct {
+	File string `json:"file"`
+	// Origin completes the relative names of the file until a $ORIGIN directive.
+	// Without one, the file has to set it before any relative name.
+	Origin string `json:"origin,omitempty"`
+}
+
 type Config struct {
 	cliOptions
 	fileOptions
@@ -32,17 +121,76 @@ type Config struct {
 
 var config Config
 
+// Load reads the config file named by the command line flags, then applies the flags over it
 func Load() error {
-	flag.StringVar(&config.Resolver, "resolver", "", "resolver address to forward queries to (ip:port)")
-	flag.StringVar(&config.Config, "config", "", "config filepath")
-	flag.Parse()
+	loaded, err := load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		return err
+	}
+	config = loaded
+	return nil
+}
+
+// load parses args with flags, reads the config file and merges both into a Config
+func load(flags *flag.FlagSet, args []string) (Config, error) {
+	var c Config
+	var listen, upstreams, zones listFlag
+	var strategy string
+	var mixedCase, recursive bool
+	flags.Var(&upstreams, "resolver", "resolver address to forward queries to, repeatable (ip:port)")
+	flags.StringVar(&strategy, "strategy", "", "order upstream resolvers are tried in (sequential, random, round-robin, fastest)")
+	flags.BoolVar(&recursive, "recursive", false, "resolve queries from the root servers instead of forwarding them")
+	flags.BoolVar(&mixedCase, "0x20", false, "randomize the case of forwarded names, upstreams have to echo it")
+	flags.StringVar(&c.Config, "config", "", "config filepath")
+	flags.Var(&zones, "zone", "master file to serve records from, repeatable (file or file:origin)")
+	flags.Var(&listen, "listen", "address to serve on, repeatable (udp://ip:port, tcp://ip:port or ip:port for both)")
+	err := flags.Parse(args)
+	if err != nil {
+		return c, err
+	}
+
+	err = c.loadFile()
+	if err != nil {
+		return c, err
+	}
+
+	// Flags take precedence over the config file
+	if len(listen) > 0 {
+		c.Listen = listen
+	}
+	if len(c.Listen) == 0 {
+		c.Listen = []string{DefaultListen}
+	}
+	if len(upstreams) > 0 {
+		c.Upstreams = upstreams
+	}
+	if strategy != "" {
+		c.Strategy = strategy
+	}
+	for _, value := range zones {
+		file, origin, _ := strings.Cut(value, ":")
+		c.Zones = append(c.Zones, &Zone{File: file, Origin: origin})
+	}
+	if mixedCase {
+		c.MixedCase = true
+	}
+	if recursive {
+		c.Recursive = true
+	}
+	if c.MaxInFlight == 0 {
+		c.MaxInFlight = DefaultMaxInFlight
+	}
+
+	return c, nil
+}
 
+func (c *Config) loadFile() error {
 	// Config file is optional
-	if config.Config == "" {
+	if c.Config == "" {
 		return nil
 	}
 
-	file, err := os.Open(config.Config)
+	file, err := os.Open(c.Config)
 	if err != nil {
 		return fmt.Errorf("failed to open config file: %s", err)
 	}
@@ -55,7 +203,7 @@ func Load() error {
 
 	decoder := json.NewDecoder(file)
 
-	err = decoder.Decode(&config)
+	err = decoder.Decode(c)
 	if err != nil {
 		return fmt.Errorf("failed to decode config file: %s", err)
 	}
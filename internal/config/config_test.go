@@ -0,0 +1,89 @@
+package config
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadArgs loads a config from command line arguments, with a config file holding fileData when not empty
+func loadArgs(t *testing.T, fileData string, args ...string) (Config, error) {
+	if fileData != "" {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(fileData), 0o644); err != nil {
+			t.Fatal("Failed to write config file:", err)
+		}
+		args = append([]string{"-config", path}, args...)
+	}
+	flags := flag.NewFlagSet("dnsd", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	return load(flags, args)
+}
+
+func TestLoadListen(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileData string
+		args     []string
+		listen   []string
+	}{
+		{"default", "", nil, []string{DefaultListen}},
+		{"default without listen in the file", `{"maxInFlight": 10}`, nil, []string{DefaultListen}},
+		{"file", `{"listen": ["udp://127.0.0.1:53", "tcp://[::1]:53"]}`, nil, []string{"udp://127.0.0.1:53", "tcp://[::1]:53"}},
+		{"repeated flag", "", []string{"-listen", "udp://127.0.0.1:53", "-listen", "[::]:53"}, []string{"udp://127.0.0.1:53", "[::]:53"}},
+		{"comma separated flag", "", []string{"-listen", "udp://127.0.0.1:53, tcp://127.0.0.1:53"}, []string{"udp://127.0.0.1:53", "tcp://127.0.0.1:53"}},
+		// Flags replace the addresses of the file rather than adding to them
+		{"flag over file", `{"listen": ["127.0.0.1:53"]}`, []string{"-listen", "tcp://127.0.0.1:5353"}, []string{"tcp://127.0.0.1:5353"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := loadArgs(t, test.fileData, test.args...)
+			if err != nil {
+				t.Fatal("Failed to load config:", err)
+			}
+			if strings.Join(c.Listen, " ") != strings.Join(test.listen, " ") {
+				t.Errorf("Expected listen %v, got %v", test.listen, c.Listen)
+			}
+		})
+	}
+}
+
+func TestLoadMerge(t *testing.T) {
+	c, err := loadArgs(t, `{
+		"upstreams": ["192.0.2.1:53"],
+		"strategy": "random",
+		"zones": [{"file": "a.zone", "origin": "a.test"}]
+	}`, "-resolver", "192.0.2.2:53", "-zone", "b.zone", "-zone", "c.zone:c.test", "-0x20")
+	if err != nil {
+		t.Fatal("Failed to load config:", err)
+	}
+	if len(c.Upstreams) != 1 || c.Upstreams[0] != "192.0.2.2:53" {
+		t.Errorf("Expected the upstream of the flag, got %v", c.Upstreams)
+	}
+	if c.Strategy != "random" || !c.MixedCase || c.MaxInFlight != DefaultMaxInFlight {
+		t.Errorf("Expected the file strategy, 0x20 and the default max in flight, got %q %t %d", c.Strategy, c.MixedCase, c.MaxInFlight)
+	}
+	// Zone flags add to the zones of the file
+	if len(c.Zones) != 3 || c.Zones[0].File != "a.zone" || c.Zones[1].File != "b.zone" || c.Zones[2].File != "c.zone" {
+		t.Errorf("Expected every zone, got %v", c.Zones)
+	}
+	// A zone flag may give the origin after the file
+	if len(c.Zones) == 3 && (c.Zones[1].Origin != "" || c.Zones[2].Origin != "c.test") {
+		t.Errorf("Expected the origin c.test for c.zone only, got %q and %q", c.Zones[1].Origin, c.Zones[2].Origin)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	if _, err := loadArgs(t, `{"listen": "127.0.0.1:53"}`); err == nil {
+		t.Error("Expected a listen address that is not a list to fail")
+	}
+	if _, err := loadArgs(t, "", "-config", filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Expected a missing config file to fail")
+	}
+	if _, err := loadArgs(t, "", "-unknown"); err == nil {
+		t.Error("Expected an unknown flag to fail")
+	}
+}
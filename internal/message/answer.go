@@ -1,12 +1,12 @@
 package message
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 )
 
-// Answer is a struct that represents a DNS answer
+// Answer is a struct that represents a DNS resource record.
+// It is used for the answer, authority and additional sections alike.
 // https://www.rfc-editor.org/rfc/rfc1035#section-3.2.1
 type Answer struct {
 	Name string
@@ -20,22 +20,34 @@ type Answer struct {
 	// The duration that the RR can be cached before querying the DNS server again
 	TTL uint32
 	// Length of the Data field in bytes (RDLENGTH)
+	// It is only set when decoding, encoding computes it from Data
 	Length uint16
-	// Data specific to the query type (RDATA)
-	Data []byte // TODO: Handle different record types
+	// Data specific to the record type (RDATA)
+	Data RData
 }
 
+// Bytes returns a byte array representation of the Answer, or nil when a name does not fit the wire format.
+// Names are not compressed, so the record can be appended to any message.
 func (a Answer) Bytes() []byte {
-	var buff bytes.Buffer
-
-	buff.Write(serializeDomainName(a.Name))
-	binary.Write(&buff, binary.BigEndian, a.Type)
-	binary.Write(&buff, binary.BigEndian, a.Class)
-	binary.Write(&buff, binary.BigEndian, a.TTL)
-	binary.Write(&buff, binary.BigEndian, uint16(len(a.Data)))
-	buff.Write(a.Data)
+	e := newStandaloneEncoder()
+	a.encode(e)
+	if e.err != nil {
+		return nil
+	}
+	return e.Bytes()
+}
 
-	return buff.Bytes()[:buff.Len()]
+// encode writes the Answer to a message being encoded
+func (a Answer) encode(e *encoder) {
+	e.writeDomainName(a.Name)
+	e.writeUint16(a.Type)
+	e.writeUint16(a.Class)
+	e.writeUint32(a.TTL)
+	e.writeLength(func() {
+		if a.Data != nil {
+			a.Data.encode(e)
+		}
+	})
 }
 
 // String returns a string representation of the Answer struct
@@ -50,19 +62,46 @@ func (a Answer) String() string {
 	)
 }
 
-// answersFromBytes decodes the DNS message answer section from the message packet
-func answersFromBytes(data []byte, offset *int, count uint16) []*Answer {
-	result := make([]*Answer, count)
+// minAnswerSize is the size of the smallest resource record: the root name, a type, a class,
+// a TTL and an RDATA length of zero
+const minAnswerSize = 1 + 2 + 2 + 4 + 2
+
+// answersFromBytes decodes a DNS message resource record section from the message packet
+func answersFromBytes(data []byte, offset *int, count uint16) ([]*Answer, error) {
+	// The count comes from the sender, only what the remaining bytes can hold is allocated up front
+	result := make([]*Answer, 0, sectionCapacity(data, *offset, count, minAnswerSize))
 	for i := 0; i < int(count); i++ {
-		answer := answerFromBytes(data, offset)
-		result[i] = answer
+		answer, err := answerFromBytes(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, answer)
 	}
-	return result
+	return result, nil
+}
+
+// sectionCapacity returns the number of entries of a section worth allocating:
+// its count, unless the rest of the packet is too short to hold that many entries of minSize bytes
+func sectionCapacity(data []byte, offset int, count uint16, minSize int) int {
+	fit := 0
+	if offset < len(data) {
+		fit = (len(data) - offset) / minSize
+	}
+	if fit < int(count) {
+		return fit
+	}
+	return int(count)
 }
 
 // answerFromBytes decodes a DNS message answer from answer section of the message packet
-func answerFromBytes(data []byte, offset *int) *Answer {
-	name := domainNameFromBytes(data, offset)
+func answerFromBytes(data []byte, offset *int) (*Answer, error) {
+	name, err := domainNameFromBytes(data, offset)
+	if err != nil {
+		return nil, err
+	}
+	if *offset+10 > len(data) {
+		return nil, newDecodeError(ErrTruncatedRecord, *offset)
+	}
 	answer := &Answer{
 		Name:   name,
 		Type:   binary.BigEndian.Uint16(data[*offset : *offset+2]),
@@ -71,8 +110,9 @@ func answerFromBytes(data []byte, offset *int) *Answer {
 		Length: binary.BigEndian.Uint16(data[*offset+8 : *offset+10]),
 	}
 	*offset += 10
-	answer.Data = data[*offset : *offset+int(answer.Length)]
-	*offset += int(answer.Length)
-	fmt.Println(answer.String())
-	return answer
+	answer.Data, err = rdataFromBytes(data, offset, answer.Type, answer.Length)
+	if err != nil {
+		return nil, err
+	}
+	return answer, nil
 }
@@ -1,45 +1,79 @@
 package message
 
 import (
-	"bytes"
 	"encoding/binary"
 	"strings"
 )
 
-func serializeDomainName(domain string) []byte {
-	var buff bytes.Buffer
+// maxNameLength is the maximum length of a domain name on the wire,
+// including the length octets and the terminating root label
+// https://www.rfc-editor.org/rfc/rfc1035#section-3.1
+const maxNameLength = 255
 
-	labels := strings.Split(domain, ".")
-	for _, label := range labels {
-		buff.WriteByte(byte(len(label)))
-		buff.Write([]byte(label))
-	}
-	buff.WriteByte(0x00)
-
-	return buff.Bytes()
-}
+// maxLabelLength is the maximum length of a label, the top two bits of a length octet mark pointers
+const maxLabelLength = 63
 
-func domainNameFromBytes(data []byte, offset *int) string {
+// domainNameFromBytes decodes a domain name starting at offset, following compression pointers.
+// The offset is advanced past the name as it appears in place, not past any pointed-to labels.
+//
+// Every pointer must jump strictly backwards, before the start of the labels read so far.
+// That guarantees decoding terminates: a pointer into the labels already read is a loop
+// and a pointer beyond them references data that was not written yet.
+func domainNameFromBytes(data []byte, offset *int) (string, error) {
 	var result []string
+	position := *offset
+	// Start of the labels being read, pointers must jump before it
+	segmentStart := position
+	jumped := false
+	nameLength := 0
 	for {
+		if position >= len(data) {
+			return "", newDecodeError(ErrTruncatedName, position)
+		}
+		length := int(data[position])
+
 		// If first two bits are 1, it's a pointer
-		if ((data[*offset] >> 6) & 0x3) == 0x3 {
-			nameOffset := int((binary.BigEndian.Uint16(data[*offset:*offset+2]) << 2) >> 2)
-			result = append(result, domainNameFromBytes(data, &nameOffset))
-			*offset += 2
-			break
+		if ((length >> 6) & 0x3) == 0x3 {
+			if position+2 > len(data) {
+				return "", newDecodeError(ErrTruncatedName, position)
+			}
+			target := int(binary.BigEndian.Uint16(data[position:position+2]) & 0x3FFF)
+			if target > position {
+				return "", newDecodeError(ErrForwardPointer, position)
+			}
+			if target >= segmentStart {
+				return "", newDecodeError(ErrPointerLoop, position)
+			}
+			if !jumped {
+				*offset = position + 2
+				jumped = true
+			}
+			position = target
+			segmentStart = target
+			continue
+		}
+		// Lengths with the 01 and 10 prefixes are not plain labels
+		if length > maxLabelLength {
+			return "", newDecodeError(ErrLabelTooLong, position)
 		}
 
-		length := int(data[*offset])
-		*offset++
-		label := string(data[*offset : *offset+length])
-		result = append(result, label)
-		*offset += length
+		nameLength += length + 1
+		if nameLength > maxNameLength {
+			return "", newDecodeError(ErrNameTooLong, position)
+		}
 
-		if data[*offset] == 0x00 {
-			*offset += 1
+		position++
+		if length == 0 {
 			break
 		}
+		if position+length > len(data) {
+			return "", newDecodeError(ErrTruncatedName, position)
+		}
+		result = append(result, string(data[position:position+length]))
+		position += length
+	}
+	if !jumped {
+		*offset = position
 	}
-	return strings.Join(result, ".")
+	return strings.Join(result, "."), nil
 }
@@ -0,0 +1,164 @@
+package message
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// UDP payload sizes
+const (
+	// MinUDPPayloadSize is the size every DNS message over UDP may use, even without EDNS(0)
+	MinUDPPayloadSize = 512
+	// DefaultUDPPayloadSize is the payload size advertised by this server.
+	// It avoids IP fragmentation on common networks.
+	// https://www.dnsflagday.net/2020/
+	DefaultUDPPayloadSize = 1232
+)
+
+// BadVersion is the extended response code (BADVERS) for an unsupported EDNS version.
+// It does not fit in the 4 bit header RCODE, the upper bits go in the OPT record.
+// https://www.rfc-editor.org/rfc/rfc6891#section-9
+const BadVersion uint16 = 16
+
+// EDNSOption is an option carried in the OPT pseudo-record
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// OPT is the data of the EDNS(0) pseudo-record
+// https://www.rfc-editor.org/rfc/rfc6891#section-6.1.2
+type OPT struct {
+	Options []EDNSOption
+}
+
+func (r *OPT) Type() uint16 { return TypeOPT }
+
+func (r *OPT) String() string {
+	options := make([]string, len(r.Options))
+	for i, option := range r.Options {
+		options[i] = fmt.Sprintf("%d:%s", option.Code, hex.EncodeToString(option.Data))
+	}
+	return strings.Join(options, " ")
+}
+
+func (r *OPT) encode(e *encoder) {
+	for _, option := range r.Options {
+		e.writeUint16(option.Code)
+		e.writeUint16(uint16(len(option.Data)))
+		e.write(option.Data)
+	}
+}
+
+func optFromBytes(data []byte, offset *int) (RData, error) {
+	opt := &OPT{}
+	for *offset < len(data) {
+		code, err := uint16FromBytes(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		length, err := uint16FromBytes(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		if *offset+int(length) > len(data) {
+			return nil, newDecodeError(ErrRDataOverrun, *offset)
+		}
+		opt.Options = append(opt.Options, EDNSOption{
+			Code: code,
+			Data: copyBytes(data[*offset : *offset+int(length)]),
+		})
+		*offset += int(length)
+	}
+	return opt, nil
+}
+
+// EDNS is the EDNS(0) information of a message, stored on the wire as an OPT
+// pseudo-record in the additional section. The record reuses the CLASS field for
+// the payload size and the TTL field for the extended RCODE, version and flags.
+// https://www.rfc-editor.org/rfc/rfc6891#section-6.1.3
+type EDNS struct {
+	// UDPSize is the largest UDP payload the sender can reassemble
+	UDPSize uint16
+	// ExtendedResponseCode holds the upper 8 bits of the 12 bit response code
+	ExtendedResponseCode uint8
+	// Version of EDNS, only version 0 exists
+	Version uint8
+	// DNSSECOK represents the DNSSEC OK (DO) flag
+	DNSSECOK bool
+	Options  []EDNSOption
+}
+
+// EDNS returns the EDNS(0) information of the message, or nil when it has no OPT record
+func (m *Message) EDNS() *EDNS {
+	for _, record := range m.Additional {
+		if record.Type != TypeOPT {
+			continue
+		}
+		edns := &EDNS{
+			UDPSize:              record.Class,
+			ExtendedResponseCode: uint8(record.TTL >> 24),
+			Version:              uint8(record.TTL >> 16),
+			DNSSECOK:             (record.TTL>>15)&0x01 != 0,
+		}
+		if opt, ok := record.Data.(*OPT); ok {
+			edns.Options = opt.Options
+		}
+		return edns
+	}
+	return nil
+}
+
+// SetEDNS replaces the OPT record of the message, removing it when edns is nil
+func (m *Message) SetEDNS(edns *EDNS) {
+	additional := make([]*Answer, 0, len(m.Additional)+1)
+	for _, record := range m.Additional {
+		if record.Type != TypeOPT {
+			additional = append(additional, record)
+		}
+	}
+	if edns != nil {
+		additional = append(additional, edns.record())
+	}
+	m.Additional = additional
+}
+
+// OPTCount returns the number of OPT records, more than one makes the message malformed
+func (m *Message) OPTCount() int {
+	count := 0
+	for _, record := range m.Additional {
+		if record.Type == TypeOPT {
+			count++
+		}
+	}
+	return count
+}
+
+// PayloadSize returns the UDP payload size a response to this message may use,
+// capped to the size advertised by this server
+func (m *Message) PayloadSize() int {
+	edns := m.EDNS()
+	if edns == nil || edns.UDPSize < MinUDPPayloadSize {
+		return MinUDPPayloadSize
+	}
+	if edns.UDPSize > DefaultUDPPayloadSize {
+		return DefaultUDPPayloadSize
+	}
+	return int(edns.UDPSize)
+}
+
+func (e *EDNS) record() *Answer {
+	ttl := uint32(e.ExtendedResponseCode)<<24 | uint32(e.Version)<<16
+	if e.DNSSECOK {
+		ttl |= 1 << 15
+	}
+	return &Answer{
+		// The owner name is always the root domain
+		Name:  "",
+		Type:  TypeOPT,
+		Class: e.UDPSize,
+		TTL:   ttl,
+		Data:  &OPT{Options: e.Options},
+	}
+}
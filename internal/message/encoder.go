@@ -0,0 +1,129 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// maxPointerOffset is the largest offset a compression pointer can reference (14 bits)
+const maxPointerOffset = 0x3FFF
+
+// encoder serializes a DNS message, replacing repeated domain names with compression pointers
+// https://www.rfc-editor.org/rfc/rfc1035#section-4.1.4
+type encoder struct {
+	buff bytes.Buffer
+	// names maps every domain name suffix already written to its offset in the message
+	names map[string]int
+	// err is the error of the first name that could not be written
+	err error
+	// standalone is set when encoding a part of a message on its own, whose offsets
+	// would be wrong once it is put in a message, so names are never compressed
+	standalone bool
+}
+
+func newEncoder() *encoder {
+	return &encoder{
+		names: make(map[string]int),
+	}
+}
+
+// newStandaloneEncoder creates an encoder for a question or record that can be appended to any message
+func newStandaloneEncoder() *encoder {
+	e := newEncoder()
+	e.standalone = true
+	return e
+}
+
+// Bytes returns the encoded message
+func (e *encoder) Bytes() []byte {
+	return e.buff.Bytes()
+}
+
+func (e *encoder) write(data []byte) {
+	e.buff.Write(data)
+}
+
+func (e *encoder) writeUint16(value uint16) {
+	binary.Write(&e.buff, binary.BigEndian, value)
+}
+
+func (e *encoder) writeUint32(value uint32) {
+	binary.Write(&e.buff, binary.BigEndian, value)
+}
+
+// writeCharacterString writes a length prefixed character string
+func (e *encoder) writeCharacterString(text string) {
+	e.buff.WriteByte(byte(len(text)))
+	e.buff.WriteString(text)
+}
+
+// writeLength writes the length of the data written by write, as needed for RDLENGTH
+func (e *encoder) writeLength(write func()) {
+	position := e.buff.Len()
+	e.writeUint16(0)
+	write()
+	length := e.buff.Len() - position - 2
+	binary.BigEndian.PutUint16(e.buff.Bytes()[position:position+2], uint16(length))
+}
+
+// writeDomainName writes a domain name as a sequence of labels.
+// The longest suffix already present in the message is replaced by a pointer to it.
+func (e *encoder) writeDomainName(domain string) {
+	e.writeName(domain, !e.standalone)
+}
+
+// writeUncompressedDomainName writes a domain name in full, for places where
+// compression is not allowed. Its suffixes can still be pointed to by later names.
+func (e *encoder) writeUncompressedDomainName(domain string) {
+	e.writeName(domain, false)
+}
+
+func (e *encoder) writeName(domain string, compress bool) {
+	domain = strings.TrimSuffix(domain, ".")
+	if err := CheckName(domain); err != nil {
+		if e.err == nil {
+			e.err = err
+		}
+		return
+	}
+	for domain != "" {
+		if offset, ok := e.names[domain]; ok && compress {
+			e.writeUint16(0xC000 | uint16(offset))
+			return
+		}
+		if _, ok := e.names[domain]; !ok && e.buff.Len() <= maxPointerOffset {
+			e.names[domain] = e.buff.Len()
+		}
+
+		label, rest, _ := strings.Cut(domain, ".")
+		e.buff.WriteByte(byte(len(label)))
+		e.buff.WriteString(label)
+		domain = rest
+	}
+	e.buff.WriteByte(0x00)
+}
+
+// CheckName checks that a name, with or without its trailing dot, fits the wire format:
+// labels of 1 to 63 octets making up at most 255 octets
+// https://www.rfc-editor.org/rfc/rfc1035#section-3.1
+func CheckName(name string) error {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil
+	}
+	// Each label is preceded by its length, and the name ends with the empty root label
+	if len(name)+2 > maxNameLength {
+		return fmt.Errorf("%w: %d octets", ErrNameTooLong, len(name)+2)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return fmt.Errorf("%w in %q", ErrEmptyLabel, name)
+		}
+		if len(label) > maxLabelLength {
+			return fmt.Errorf("%w: %q", ErrLabelTooLong, label)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned while decoding a DNS message.
+// They are wrapped in a DecodeError carrying the offset where decoding failed,
+// so callers should compare them using errors.Is.
+// The name errors are also returned when encoding a name that does not fit the wire format.
+var (
+	ErrTruncatedHeader   = errors.New("truncated header")
+	ErrTruncatedName     = errors.New("truncated domain name")
+	ErrTruncatedQuestion = errors.New("truncated question")
+	ErrTruncatedRecord   = errors.New("truncated resource record")
+	ErrLabelTooLong      = errors.New("label exceeds 63 octets")
+	ErrNameTooLong       = errors.New("domain name exceeds 255 octets")
+	ErrEmptyLabel        = errors.New("empty label")
+	ErrPointerLoop       = errors.New("compression pointer loop")
+	ErrForwardPointer    = errors.New("compression pointer points forward")
+	ErrRDataOverrun      = errors.New("resource data overruns the message")
+	ErrInvalidRData      = errors.New("invalid resource data")
+)
+
+// DecodeError is an error that occurred while decoding a DNS message
+type DecodeError struct {
+	// Err is one of the decoding errors defined in this package
+	Err error
+	// Offset is the position in the packet where decoding failed
+	Offset int
+}
+
+func newDecodeError(err error, offset int) *DecodeError {
+	return &DecodeError{
+		Err:    err,
+		Offset: offset,
+	}
+}
+
+// Error returns a string representation of the DecodeError
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s at offset %d", e.Err, e.Offset)
+}
+
+// Unwrap returns the underlying decoding error
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
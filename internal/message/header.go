@@ -61,7 +61,11 @@ type ResponseCode uint8
 
 const (
 	Succeeded      ResponseCode = 0
+	FormatError    ResponseCode = 1
+	ServerFailure  ResponseCode = 2
+	NameError      ResponseCode = 3
 	NotImplemented ResponseCode = 4
+	Refused        ResponseCode = 5
 )
 
 func (h *Header) Bytes() []byte {
@@ -101,16 +105,21 @@ func (h *Header) Bytes() []byte {
 
 // String returns a string representation of the Header struct
 func (h *Header) String() string {
-	return fmt.Sprintf("Header{ID: %d, OPCODE: %d, QDCOUNT: %d, ANCOUNT: %d}",
+	return fmt.Sprintf("Header{ID: %d, OPCODE: %d, QDCOUNT: %d, ANCOUNT: %d, NSCOUNT: %d, ARCOUNT: %d}",
 		h.ID,
 		h.OperationCode,
 		h.QuestionCount,
 		h.AnswerCount,
+		h.AuthorityCount,
+		h.AdditionalCount,
 	)
 }
 
 // headerFromBytes decodes the DNS message header from the message packet
-func headerFromBytes(packet []byte, offset *int) *Header {
+func headerFromBytes(packet []byte, offset *int) (*Header, error) {
+	if len(packet) < 12 {
+		return nil, newDecodeError(ErrTruncatedHeader, len(packet))
+	}
 	flags := binary.BigEndian.Uint16(packet[2:4])
 	header := &Header{
 		ID:                  binary.BigEndian.Uint16(packet[0:2]),
@@ -121,14 +130,14 @@ func headerFromBytes(packet []byte, offset *int) *Header {
 		RecursionDesired:    (flags >> 8 & 0x01) != 0,
 		RecursionAvailable:  (flags >> 7 & 0x01) != 0,
 		Reserved:            uint8((flags >> 4)) & 0x07,
+		ResponseCode:        ResponseCode(flags & 0x0F),
 		QuestionCount:       binary.BigEndian.Uint16(packet[4:6]),
 		AnswerCount:         binary.BigEndian.Uint16(packet[6:8]),
 		AuthorityCount:      binary.BigEndian.Uint16(packet[8:10]),
 		AdditionalCount:     binary.BigEndian.Uint16(packet[10:12]),
 	}
 	*offset += 12
-	fmt.Println(header.String())
-	return header
+	return header, nil
 }
 
 func GetResponseCode(header *Header) ResponseCode {
@@ -1,35 +1,98 @@
 package message
 
-import (
-	"bytes"
-)
-
 // Message is a struct that represents a DNS internal
 type Message struct {
 	Header    *Header
 	Questions []*Question
 	Answers   []*Answer
+	// Authority holds the resource records pointing toward an authority (NS, SOA)
+	Authority []*Answer
+	// Additional holds the resource records related to the query (glue, OPT)
+	Additional []*Answer
 }
 
-// Bytes returns a byte array representation of the DNS message
+// Bytes returns a byte array representation of the DNS message, or nil when it cannot be encoded.
+// Use Pack to know why a message fails to encode.
 func (m *Message) Bytes() []byte {
-	var buffer bytes.Buffer
-	buffer.Write(m.Header.Bytes())
+	packet, _ := m.Pack()
+	return packet
+}
+
+// Pack encodes the DNS message, failing on names that do not fit the wire format.
+// Repeated domain names are compressed across all sections.
+// The section counts in the header are taken from the length of each section.
+func (m *Message) Pack() ([]byte, error) {
+	header := *m.Header
+	header.QuestionCount = uint16(len(m.Questions))
+	header.AnswerCount = uint16(len(m.Answers))
+	header.AuthorityCount = uint16(len(m.Authority))
+	header.AdditionalCount = uint16(len(m.Additional))
+
+	e := newEncoder()
+	e.write(header.Bytes())
 	for _, question := range m.Questions {
-		buffer.Write(question.Bytes())
+		question.encode(e)
+	}
+	for _, section := range [][]*Answer{m.Answers, m.Authority, m.Additional} {
+		for _, record := range section {
+			record.encode(e)
+		}
+	}
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.Bytes(), nil
+}
+
+// Truncate removes resource records until the encoded message fits in size bytes.
+// Additional records other than OPT are dropped first, they are optional.
+// The Truncated flag is set once answer or authority records have to be removed.
+// https://www.rfc-editor.org/rfc/rfc2181#section-9
+func (m *Message) Truncate(size int) {
+	if len(m.Bytes()) <= size {
+		return
 	}
-	for _, answer := range m.Answers {
-		buffer.Write(answer.Bytes())
+	edns := m.EDNS()
+	m.Additional = nil
+	m.SetEDNS(edns)
+	for len(m.Bytes()) > size {
+		switch {
+		case len(m.Authority) > 0:
+			m.Authority = m.Authority[:len(m.Authority)-1]
+		case len(m.Answers) > 0:
+			m.Answers = m.Answers[:len(m.Answers)-1]
+		default:
+			return
+		}
+		m.Header.Truncated = true
 	}
-	return buffer.Bytes()
 }
 
-// FromBytes decodes a DNS message from a byte array
-func FromBytes(packet []byte) *Message {
+// FromBytes decodes a DNS message from a byte array.
+// Malformed packets are reported with a *DecodeError instead of panicking.
+func FromBytes(packet []byte) (*Message, error) {
 	var offset int
+	var err error
 	message := &Message{}
-	message.Header = headerFromBytes(packet, &offset)
-	message.Questions = questionsFromBytes(packet, &offset, message.Header.QuestionCount)
-	message.Answers = answersFromBytes(packet, &offset, message.Header.AnswerCount)
-	return message
+	message.Header, err = headerFromBytes(packet, &offset)
+	if err != nil {
+		return nil, err
+	}
+	message.Questions, err = questionsFromBytes(packet, &offset, message.Header.QuestionCount)
+	if err != nil {
+		return nil, err
+	}
+	message.Answers, err = answersFromBytes(packet, &offset, message.Header.AnswerCount)
+	if err != nil {
+		return nil, err
+	}
+	message.Authority, err = answersFromBytes(packet, &offset, message.Header.AuthorityCount)
+	if err != nil {
+		return nil, err
+	}
+	message.Additional, err = answersFromBytes(packet, &offset, message.Header.AdditionalCount)
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
 }
@@ -1,6 +1,11 @@
 package message
 
 import (
+	"bytes"
+	"errors"
+	"net"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -18,7 +23,10 @@ func TestDecodeMessage(t *testing.T) {
 		0x00, 0x01, // Type
 		0x00, 0x01, // Class
 	}
-	message := FromBytes(packet)
+	message, err := FromBytes(packet)
+	if err != nil {
+		t.Fatal("Failed to decode message:", err)
+	}
 	if message.Header.ID != 1 {
 		t.Error("Failed to decode ID")
 	}
@@ -79,7 +87,10 @@ func TestDecodeCompressedMessage(t *testing.T) {
 		0x00, 0x01, // Type
 		0x00, 0x01, // Class
 	}
-	message := FromBytes(packet)
+	message, err := FromBytes(packet)
+	if err != nil {
+		t.Fatal("Failed to decode message:", err)
+	}
 	if len(message.Questions) != 2 {
 		t.Error("Failed to decode questions")
 	}
@@ -90,3 +101,398 @@ func TestDecodeCompressedMessage(t *testing.T) {
 		t.Error("Failed to decode second question name")
 	}
 }
+
+func TestEncodeCompressedMessage(t *testing.T) {
+	message := &Message{
+		Header: &Header{ID: 1, IsResponse: true, QuestionCount: 1, AnswerCount: 3},
+		Questions: []*Question{
+			{Name: "abc.com", Type: 1, Class: 1},
+		},
+		Answers: []*Answer{
+			{Name: "abc.com", Type: 1, Class: 1, TTL: 60, Data: &A{IP: net.IP{1, 1, 1, 1}}},
+			{Name: "abc.com.", Type: 1, Class: 1, TTL: 60, Data: &A{IP: net.IP{2, 2, 2, 2}}},
+			{Name: "def.abc.com", Type: 1, Class: 1, TTL: 60, Data: &A{IP: net.IP{3, 3, 3, 3}}},
+		},
+	}
+	expected := []byte{
+		0x00, 0x01, // ID
+		0x80, 0x00, // Flags
+		0x00, 0x01, // Question count
+		0x00, 0x03, // Answer count
+		0x00, 0x00, // Authority count
+		0x00, 0x00, // Additional count
+		0x03, 0x61, 0x62, 0x63, // abc
+		0x03, 0x63, 0x6f, 0x6d, // com
+		0x00,       // End of domain name
+		0x00, 0x01, // Type
+		0x00, 0x01, // Class
+		0xc0, 0x0c, // Pointer to abc.com
+		0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3c, 0x00, 0x04, 0x01, 0x01, 0x01, 0x01,
+		0xc0, 0x0c, // Pointer to abc.com
+		0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3c, 0x00, 0x04, 0x02, 0x02, 0x02, 0x02,
+		0x03, 0x64, 0x65, 0x66, // def
+		0xc0, 0x0c, // Pointer to abc.com
+		0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3c, 0x00, 0x04, 0x03, 0x03, 0x03, 0x03,
+	}
+	packet := message.Bytes()
+	if !bytes.Equal(packet, expected) {
+		t.Fatalf("Failed to compress message\nexpected % x\ngot      % x", expected, packet)
+	}
+	decoded, err := FromBytes(packet)
+	if err != nil {
+		t.Fatal("Failed to decode compressed message:", err)
+	}
+	if decoded.Answers[2].Name != "def.abc.com" {
+		t.Error("Failed to decode compressed answer name")
+	}
+}
+
+func TestEncodeAllSections(t *testing.T) {
+	message := &Message{
+		Header: &Header{ID: 1, IsResponse: true, ResponseCode: NameError},
+		Questions: []*Question{
+			{Name: "abc.com", Type: 1, Class: 1},
+		},
+		Authority: []*Answer{
+			{Name: "abc.com", Type: 2, Class: 1, TTL: 60, Data: &NS{Host: "ns.abc.com"}},
+		},
+		Additional: []*Answer{
+			{Name: "ns.abc.com", Type: 1, Class: 1, TTL: 60, Data: &A{IP: net.IP{1, 1, 1, 1}}},
+		},
+	}
+	decoded, err := FromBytes(message.Bytes())
+	if err != nil {
+		t.Fatal("Failed to decode message:", err)
+	}
+	if decoded.Header.QuestionCount != 1 || decoded.Header.AnswerCount != 0 ||
+		decoded.Header.AuthorityCount != 1 || decoded.Header.AdditionalCount != 1 {
+		t.Error("Failed to sync header counts:", decoded.Header)
+	}
+	if decoded.Header.ResponseCode != NameError {
+		t.Error("Failed to decode RCODE")
+	}
+	if len(decoded.Authority) != 1 || decoded.Authority[0].Type != 2 {
+		t.Error("Failed to decode authority section")
+	}
+	if len(decoded.Additional) != 1 || decoded.Additional[0].Name != "ns.abc.com" {
+		t.Error("Failed to decode additional section")
+	}
+}
+
+func TestEncodeEDNS(t *testing.T) {
+	message := &Message{
+		Header: &Header{ID: 1},
+		Questions: []*Question{
+			{Name: "abc.com", Type: TypeA, Class: ClassINET},
+		},
+	}
+	message.SetEDNS(&EDNS{
+		UDPSize:  4096,
+		DNSSECOK: true,
+		Options:  []EDNSOption{{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}},
+	})
+	decoded, err := FromBytes(message.Bytes())
+	if err != nil {
+		t.Fatal("Failed to decode message:", err)
+	}
+	edns := decoded.EDNS()
+	if edns == nil {
+		t.Fatal("Failed to decode OPT record")
+	}
+	if edns.UDPSize != 4096 || !edns.DNSSECOK || edns.Version != 0 {
+		t.Errorf("Failed to decode EDNS flags: %+v", edns)
+	}
+	if len(edns.Options) != 1 || edns.Options[0].Code != 10 || len(edns.Options[0].Data) != 8 {
+		t.Errorf("Failed to decode EDNS options: %+v", edns.Options)
+	}
+	if decoded.PayloadSize() != DefaultUDPPayloadSize {
+		t.Errorf("Expected payload size %d, got %d", DefaultUDPPayloadSize, decoded.PayloadSize())
+	}
+
+	decoded.SetEDNS(nil)
+	if decoded.EDNS() != nil || decoded.PayloadSize() != MinUDPPayloadSize {
+		t.Error("Failed to remove OPT record")
+	}
+}
+
+func TestTruncateMessage(t *testing.T) {
+	message := &Message{
+		Header: &Header{ID: 1, IsResponse: true},
+		Questions: []*Question{
+			{Name: "abc.com", Type: TypeTXT, Class: ClassINET},
+		},
+		Additional: []*Answer{
+			{Name: "ns.abc.com", Type: TypeA, Class: ClassINET, TTL: 60, Data: &A{IP: net.IP{1, 1, 1, 1}}},
+		},
+	}
+	for i := 0; i < 10; i++ {
+		text := string(bytes.Repeat([]byte{byte('a' + i)}, 100))
+		message.Answers = append(message.Answers, &Answer{
+			Name: "abc.com", Type: TypeTXT, Class: ClassINET, TTL: 60, Data: &TXT{Texts: []string{text}},
+		})
+	}
+	message.SetEDNS(&EDNS{UDPSize: DefaultUDPPayloadSize})
+
+	message.Truncate(MinUDPPayloadSize)
+	packet := message.Bytes()
+	if len(packet) > MinUDPPayloadSize {
+		t.Errorf("Expected at most %d bytes, got %d", MinUDPPayloadSize, len(packet))
+	}
+	if !message.Header.Truncated {
+		t.Error("Expected TC flag to be set")
+	}
+	if len(message.Answers) != 4 {
+		t.Errorf("Expected 4 answers to fit, got %d", len(message.Answers))
+	}
+	if len(message.Additional) != 1 || message.EDNS() == nil {
+		t.Error("Expected only the OPT record to remain in the additional section")
+	}
+}
+
+func FuzzFromBytes(f *testing.F) {
+	f.Add([]byte{
+		0x00, 0x01, 0x01, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x03, 0x61, 0x62, 0x63, 0x03, 0x63, 0x6f, 0x6d, 0x00, 0x00, 0x01, 0x00, 0x01,
+		0x03, 0x64, 0x65, 0x66, 0xc0, 0x10, 0x00, 0x01, 0x00, 0x01,
+	})
+	// Pointer to itself
+	f.Add([]byte{
+		0x00, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01,
+	})
+	// Two pointers referencing each other
+	f.Add([]byte{
+		0x00, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x01, 0x61, 0xc0, 0x10, 0x01, 0x62, 0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01,
+	})
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		message, err := FromBytes(packet)
+		if err != nil {
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) {
+				t.Fatalf("Expected a DecodeError, got %v", err)
+			}
+			return
+		}
+		for _, question := range message.Questions {
+			// Presentation format drops the length octets and the root label
+			if len(question.Name) > maxNameLength-2 {
+				t.Errorf("Decoded name exceeds %d octets: %q", maxNameLength, question.Name)
+			}
+		}
+	})
+}
+
+func FuzzDomainNameFromBytes(f *testing.F) {
+	f.Add([]byte{0x03, 0x61, 0x62, 0x63, 0x00, 0xc0, 0x00}, 5)
+	f.Add([]byte{0xc0, 0x00}, 0)
+	f.Add([]byte{0x01, 0x61, 0xc0, 0x04, 0x01, 0x62, 0xc0, 0x00}, 4)
+	f.Fuzz(func(t *testing.T, data []byte, start int) {
+		if start < 0 || start > len(data) {
+			return
+		}
+		offset := start
+		_, err := domainNameFromBytes(data, &offset)
+		if err == nil && (offset <= start || offset > len(data)) {
+			t.Errorf("Offset moved from %d to %d in a %d byte packet", start, offset, len(data))
+		}
+	})
+}
+
+func TestDecodeMalformedMessage(t *testing.T) {
+	question := []byte{
+		0x00, 0x01, // ID
+		0x01, 0x00, // Flags
+		0x00, 0x01, // Question count
+		0x00, 0x00, // Answer count
+		0x00, 0x00, // Authority count
+		0x00, 0x00, // Additional count
+		0x03, 0x61, 0x62, 0x63, // abc
+		0x00,       // End of domain name
+		0x00, 0x01, // Type
+		0x00, 0x01, // Class
+	}
+	answer := []byte{
+		0x00, 0x01, // ID
+		0x81, 0x00, // Flags
+		0x00, 0x00, // Question count
+		0x00, 0x01, // Answer count
+		0x00, 0x00, // Authority count
+		0x00, 0x00, // Additional count
+		0x03, 0x61, 0x62, 0x63, // abc
+		0x00,       // End of domain name
+		0x00, 0x01, // Type
+		0x00, 0x01, // Class
+		0x00, 0x00, 0x0e, 0x10, // TTL
+		0x00, 0x04, // Length
+		0x08, 0x08, 0x08, 0x08, // Data
+	}
+
+	tests := []struct {
+		name   string
+		packet []byte
+		err    error
+		offset int
+	}{
+		{"empty packet", []byte{}, ErrTruncatedHeader, 0},
+		{"truncated header", question[:7], ErrTruncatedHeader, 7},
+		{"truncated label", question[:14], ErrTruncatedName, 13},
+		{"missing name terminator", question[:16], ErrTruncatedName, 16},
+		{"truncated question", question[:19], ErrTruncatedQuestion, 17},
+		{"truncated record", answer[:25], ErrTruncatedRecord, 17},
+		{"rdata overrun", answer[:len(answer)-1], ErrRDataOverrun, 27},
+		{"label too long", withBytes(question, 12, 0x40), ErrLabelTooLong, 12},
+		{"pointer loop", withBytes(question, 12, 0xc0, 0x0c), ErrPointerLoop, 12},
+		{"forward pointer", withBytes(question, 12, 0xc0, 0x0f), ErrForwardPointer, 12},
+		{"name too long", longName(question), ErrNameTooLong, 204},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := FromBytes(test.packet)
+			if message != nil {
+				t.Error("Expected no message")
+			}
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Expected error %v, got %v", test.err, err)
+			}
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) || decodeErr.Offset != test.offset {
+				t.Errorf("Expected offset %d, got %v", test.offset, err)
+			}
+		})
+	}
+}
+
+// longName returns a copy of packet with the question name replaced by one of 320 octets
+func longName(packet []byte) []byte {
+	result := make([]byte, 12, len(packet)+320)
+	copy(result, packet)
+	for i := 0; i < 5; i++ {
+		result = append(result, 63)
+		for j := 0; j < 63; j++ {
+			result = append(result, 0x61)
+		}
+	}
+	return append(result, 0x00, 0x00, 0x01, 0x00, 0x01)
+}
+
+// withBytes returns a copy of packet with the bytes starting at index replaced
+func withBytes(packet []byte, index int, values ...byte) []byte {
+	result := make([]byte, len(packet))
+	copy(result, packet)
+	copy(result[index:], values)
+	return result
+}
+
+func TestDecodeLargeCounts(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		err    error
+	}{
+		{"questions", []byte{0x00, 0x01, 0x01, 0x00, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, ErrTruncatedName},
+		{"answers", []byte{0x00, 0x01, 0x81, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, ErrTruncatedName},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			_, err := FromBytes(test.packet)
+			runtime.ReadMemStats(&after)
+			if !errors.Is(err, test.err) {
+				t.Errorf("Expected error %v, got %v", test.err, err)
+			}
+			// The counts claim 65535 entries, none of which fit in the packet
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 4096 {
+				t.Errorf("Expected a small allocation for a 12 byte packet, got %d bytes", allocated)
+			}
+		})
+	}
+}
+
+func TestEncodeInvalidNames(t *testing.T) {
+	longLabel := strings.Repeat("a", 200) + ".test"
+	longName := strings.Repeat("abcdefg.", 32) + "test"
+	tests := []struct {
+		name    string
+		message *Message
+		err     error
+	}{
+		{"question label", &Message{
+			Header:    &Header{ID: 1},
+			Questions: []*Question{{Name: longLabel, Type: TypeA, Class: ClassINET}},
+		}, ErrLabelTooLong},
+		{"record data label", &Message{
+			Header:  &Header{ID: 1, IsResponse: true},
+			Answers: []*Answer{{Name: "a.test", Type: TypeCNAME, Class: ClassINET, Data: &CNAME{Target: longLabel}}},
+		}, ErrLabelTooLong},
+		{"record name", &Message{
+			Header:    &Header{ID: 1, IsResponse: true},
+			Authority: []*Answer{{Name: longName, Type: TypeNS, Class: ClassINET, Data: &NS{Host: "ns.test"}}},
+		}, ErrNameTooLong},
+		{"empty label", &Message{
+			Header:    &Header{ID: 1},
+			Questions: []*Question{{Name: "a..test", Type: TypeA, Class: ClassINET}},
+		}, ErrEmptyLabel},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet, err := test.message.Pack()
+			if !errors.Is(err, test.err) {
+				t.Errorf("Expected error %v, got %v", test.err, err)
+			}
+			if packet != nil || test.message.Bytes() != nil {
+				t.Errorf("Expected no packet, got %x", packet)
+			}
+		})
+	}
+}
+
+func TestCheckName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"", true},
+		{".", true},
+		{"www.example.test", true},
+		{"www.example.test.", true},
+		{strings.Repeat("a", 63) + ".test", true},
+		{strings.Repeat("a", 64) + ".test", false},
+		// 253 characters are 255 octets on the wire
+		{strings.Repeat("abcdefg.", 31) + "abcde", true},
+		{strings.Repeat("abcdefg.", 31) + "abcdef", false},
+		{"a..test", false},
+		{".test", false},
+	}
+	for _, test := range tests {
+		if err := CheckName(test.name); (err == nil) != test.valid {
+			t.Errorf("Expected %q to be valid %t, got %v", test.name, test.valid, err)
+		}
+	}
+}
+
+func TestEncodeStandalone(t *testing.T) {
+	question := &Question{Name: "a.com", Type: TypeCNAME, Class: ClassINET}
+	answer := Answer{Name: "a.com", Type: TypeCNAME, Class: ClassINET, TTL: 60, Data: &CNAME{Target: "www.a.com"}}
+	answerBytes := answer.Bytes()
+	if bytes.Contains(answerBytes, []byte{0xc0}) {
+		t.Errorf("Expected no compression pointer in a standalone record, got %x", answerBytes)
+	}
+
+	// The parts are concatenated after a header counting them
+	header := &Header{ID: 1, IsResponse: true, QuestionCount: 1, AnswerCount: 1}
+	packet := append(header.Bytes(), question.Bytes()...)
+	packet = append(packet, answerBytes...)
+	decoded, err := FromBytes(packet)
+	if err != nil {
+		t.Fatal("Failed to decode message:", err)
+	}
+	if decoded.Questions[0].Name != "a.com" || decoded.Answers[0].Name != "a.com" || decoded.Answers[0].Data.String() != "www.a.com." {
+		t.Errorf("Expected the concatenated parts, got %v %v", decoded.Questions[0], decoded.Answers[0])
+	}
+
+	if (&Question{Name: strings.Repeat("a", 64), Type: TypeA, Class: ClassINET}).Bytes() != nil {
+		t.Error("Expected no encoding for a name that does not fit the wire format")
+	}
+}
@@ -1,7 +1,6 @@
 package message
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 )
@@ -20,14 +19,22 @@ type Question struct {
 	Class uint16
 }
 
+// Bytes returns a byte array representation of the Question, or nil when its name does not fit the wire format.
+// The name is not compressed, so the question can be appended to any message.
 func (q *Question) Bytes() []byte {
-	var buff bytes.Buffer
-
-	buff.Write(serializeDomainName(q.Name))
-	binary.Write(&buff, binary.BigEndian, q.Type)
-	binary.Write(&buff, binary.BigEndian, q.Class)
+	e := newStandaloneEncoder()
+	q.encode(e)
+	if e.err != nil {
+		return nil
+	}
+	return e.Bytes()
+}
 
-	return buff.Bytes()
+// encode writes the Question to a message being encoded
+func (q *Question) encode(e *encoder) {
+	e.writeDomainName(q.Name)
+	e.writeUint16(q.Type)
+	e.writeUint16(q.Class)
 }
 
 // String returns a string representation of the Question struct
@@ -39,25 +46,37 @@ func (q *Question) String() string {
 	)
 }
 
+// minQuestionSize is the size of the smallest question: the root name, a type and a class
+const minQuestionSize = 1 + 2 + 2
+
 // questionsFromBytes decodes the DNS message question section from the message packet
-func questionsFromBytes(data []byte, offset *int, count uint16) []*Question {
-	result := make([]*Question, count)
+func questionsFromBytes(data []byte, offset *int, count uint16) ([]*Question, error) {
+	// The count comes from the sender, only what the remaining bytes can hold is allocated up front
+	result := make([]*Question, 0, sectionCapacity(data, *offset, count, minQuestionSize))
 	for i := 0; i < int(count); i++ {
-		question := questionFromBytes(data, offset)
-		result[i] = question
+		question, err := questionFromBytes(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, question)
 	}
-	return result
+	return result, nil
 }
 
 // questionFromBytes decodes a DNS question from question section of the message packet
-func questionFromBytes(data []byte, offset *int) *Question {
-	name := domainNameFromBytes(data, offset)
+func questionFromBytes(data []byte, offset *int) (*Question, error) {
+	name, err := domainNameFromBytes(data, offset)
+	if err != nil {
+		return nil, err
+	}
+	if *offset+4 > len(data) {
+		return nil, newDecodeError(ErrTruncatedQuestion, *offset)
+	}
 	question := &Question{
 		Name:  name,
 		Type:  binary.BigEndian.Uint16(data[*offset : *offset+2]),
 		Class: binary.BigEndian.Uint16(data[*offset+2 : *offset+4]),
 	}
 	*offset += 4
-	fmt.Println(question.String())
-	return question
+	return question, nil
 }
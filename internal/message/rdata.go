@@ -0,0 +1,537 @@
+package message
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Resource record types
+// https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-4
+const (
+	TypeA     uint16 = 1
+	TypeNS    uint16 = 2
+	TypeCNAME uint16 = 5
+	TypeSOA   uint16 = 6
+	TypePTR   uint16 = 12
+	TypeMX    uint16 = 15
+	TypeTXT   uint16 = 16
+	TypeAAAA  uint16 = 28
+	TypeSRV   uint16 = 33
+	TypeOPT   uint16 = 41
+	TypeCAA   uint16 = 257
+)
+
+// Classes of records and questions
+const (
+	// ClassINET is the Internet class (IN)
+	ClassINET uint16 = 1
+	// ClassANY matches every class in a question (*)
+	ClassANY uint16 = 255
+)
+
+var typeNames = map[uint16]string{
+	TypeA:     "A",
+	TypeNS:    "NS",
+	TypeCNAME: "CNAME",
+	TypeSOA:   "SOA",
+	TypePTR:   "PTR",
+	TypeMX:    "MX",
+	TypeTXT:   "TXT",
+	TypeAAAA:  "AAAA",
+	TypeSRV:   "SRV",
+	TypeOPT:   "OPT",
+	TypeCAA:   "CAA",
+}
+
+// TypeToString returns the mnemonic of a record type, or TYPE<n> for unknown types
+// https://www.rfc-editor.org/rfc/rfc3597#section-5
+func TypeToString(recordType uint16) string {
+	if name, ok := typeNames[recordType]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", recordType)
+}
+
+// StringToType returns the record type for a mnemonic such as "A" or "TYPE65"
+func StringToType(name string) (uint16, bool) {
+	name = strings.ToUpper(name)
+	for recordType, typeName := range typeNames {
+		if typeName == name {
+			return recordType, true
+		}
+	}
+	if strings.HasPrefix(name, "TYPE") {
+		value, err := strconv.ParseUint(name[4:], 10, 16)
+		if err == nil {
+			return uint16(value), true
+		}
+	}
+	return 0, false
+}
+
+// RData is the type specific data of a resource record (RDATA)
+// https://www.rfc-editor.org/rfc/rfc1035#section-3.3
+type RData interface {
+	// Type returns the record type the data belongs to
+	Type() uint16
+	// String returns the data in presentation (zone file) format
+	String() string
+	// encode writes the data to a message being encoded
+	encode(e *encoder)
+}
+
+// A is an IPv4 host address
+// https://www.rfc-editor.org/rfc/rfc1035#section-3.4.1
+type A struct {
+	// IP is encoded as is, records built from untrusted input should use NewA to check it
+	IP net.IP
+}
+
+// NewA creates an A record, failing unless ip is an IPv4 address
+func NewA(ip net.IP) (*A, error) {
+	if ip.To4() == nil {
+		return nil, invalidAddress(ip, "IPv4")
+	}
+	return &A{IP: ip.To4()}, nil
+}
+
+func (r *A) Type() uint16 { return TypeA }
+
+func (r *A) String() string { return r.IP.String() }
+
+func (r *A) encode(e *encoder) { e.write(r.IP.To4()) }
+
+// AAAA is an IPv6 host address
+// https://www.rfc-editor.org/rfc/rfc3596#section-2.2
+type AAAA struct {
+	// IP is encoded as is, records built from untrusted input should use NewAAAA to check it
+	IP net.IP
+}
+
+// NewAAAA creates an AAAA record, failing unless ip is an IPv6 address.
+// IPv4 addresses, even mapped to IPv6, belong in A records.
+func NewAAAA(ip net.IP) (*AAAA, error) {
+	if len(ip) != net.IPv6len || ip.To4() != nil {
+		return nil, invalidAddress(ip, "IPv6")
+	}
+	return &AAAA{IP: ip}, nil
+}
+
+// invalidAddress describes an address that does not belong to the family of a record
+func invalidAddress(ip net.IP, family string) error {
+	if len(ip) == 0 {
+		return fmt.Errorf("missing %s address", family)
+	}
+	return fmt.Errorf("%s is not an %s address", ip, family)
+}
+
+func (r *AAAA) Type() uint16 { return TypeAAAA }
+
+func (r *AAAA) String() string { return r.IP.String() }
+
+func (r *AAAA) encode(e *encoder) { e.write(r.IP.To16()) }
+
+// NS is an authoritative name server for the owner name
+// https://www.rfc-editor.org/rfc/rfc1035#section-3.3.11
+type NS struct {
+	Host string
+}
+
+func (r *NS) Type() uint16 { return TypeNS }
+
+func (r *NS) String() string { return fqdn(r.Host) }
+
+func (r *NS) encode(e *encoder) { e.writeDomainName(r.Host) }
+
+// CNAME is the canonical name for an alias
+// https://www.rfc-editor.org/rfc/rfc1035#section-3.3.1
+type CNAME struct {
+	Target string
+}
+
+func (r *CNAME) Type() uint16 { return TypeCNAME }
+
+func (r *CNAME) String() string { return fqdn(r.Target) }
+
+func (r *CNAME) encode(e *encoder) { e.writeDomainName(r.Target) }
+
+// PTR points to another location in the domain name space
+// https://www.rfc-editor.org/rfc/rfc1035#section-3.3.12
+type PTR struct {
+	Host string
+}
+
+func (r *PTR) Type() uint16 { return TypePTR }
+
+func (r *PTR) String() string { return fqdn(r.Host) }
+
+func (r *PTR) encode(e *encoder) { e.writeDomainName(r.Host) }
+
+// MX is a mail exchange for the owner name
+// https://www.rfc-editor.org/rfc/rfc1035#section-3.3.9
+type MX struct {
+	// Preference among other MX records, lower values are preferred
+	Preference uint16
+	Exchange   string
+}
+
+func (r *MX) Type() uint16 { return TypeMX }
+
+func (r *MX) String() string {
+	return fmt.Sprintf("%d %s", r.Preference, fqdn(r.Exchange))
+}
+
+func (r *MX) encode(e *encoder) {
+	e.writeUint16(r.Preference)
+	e.writeDomainName(r.Exchange)
+}
+
+// SOA marks the start of a zone of authority
+// https://www.rfc-editor.org/rfc/rfc1035#section-3.3.13
+type SOA struct {
+	// MName is the primary name server for the zone
+	MName string
+	// RName is the mailbox of the person responsible for the zone
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	// Minimum is the TTL used for negative responses
+	// https://www.rfc-editor.org/rfc/rfc2308#section-4
+	Minimum uint32
+}
+
+func (r *SOA) Type() uint16 { return TypeSOA }
+
+func (r *SOA) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d",
+		fqdn(r.MName),
+		fqdn(r.RName),
+		r.Serial,
+		r.Refresh,
+		r.Retry,
+		r.Expire,
+		r.Minimum,
+	)
+}
+
+func (r *SOA) encode(e *encoder) {
+	e.writeDomainName(r.MName)
+	e.writeDomainName(r.RName)
+	e.writeUint32(r.Serial)
+	e.writeUint32(r.Refresh)
+	e.writeUint32(r.Retry)
+	e.writeUint32(r.Expire)
+	e.writeUint32(r.Minimum)
+}
+
+// TXT holds one or more descriptive text strings
+// https://www.rfc-editor.org/rfc/rfc1035#section-3.3.14
+type TXT struct {
+	Texts []string
+}
+
+func (r *TXT) Type() uint16 { return TypeTXT }
+
+func (r *TXT) String() string {
+	texts := make([]string, len(r.Texts))
+	for i, text := range r.Texts {
+		texts[i] = quote(text)
+	}
+	return strings.Join(texts, " ")
+}
+
+func (r *TXT) encode(e *encoder) {
+	for _, text := range r.Texts {
+		// Character strings are limited to 255 octets, split longer texts
+		for len(text) > 255 {
+			e.writeCharacterString(text[:255])
+			text = text[255:]
+		}
+		e.writeCharacterString(text)
+	}
+}
+
+// SRV is the location of a service
+// https://www.rfc-editor.org/rfc/rfc2782
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+func (r *SRV) Type() uint16 { return TypeSRV }
+
+func (r *SRV) String() string {
+	return fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, fqdn(r.Target))
+}
+
+func (r *SRV) encode(e *encoder) {
+	e.writeUint16(r.Priority)
+	e.writeUint16(r.Weight)
+	e.writeUint16(r.Port)
+	// The target must not be compressed
+	e.writeUncompressedDomainName(r.Target)
+}
+
+// CAA restricts which certification authorities may issue certificates for the owner name
+// https://www.rfc-editor.org/rfc/rfc8659#section-4
+type CAA struct {
+	Flags uint8
+	Tag   string
+	Value string
+}
+
+func (r *CAA) Type() uint16 { return TypeCAA }
+
+func (r *CAA) String() string {
+	return fmt.Sprintf("%d %s %s", r.Flags, r.Tag, quote(r.Value))
+}
+
+func (r *CAA) encode(e *encoder) {
+	e.write([]byte{r.Flags})
+	e.writeCharacterString(r.Tag)
+	e.write([]byte(r.Value))
+}
+
+// Unknown holds the opaque data of a record type without a dedicated implementation
+// https://www.rfc-editor.org/rfc/rfc3597
+type Unknown struct {
+	RRType uint16
+	Data   []byte
+}
+
+func (r *Unknown) Type() uint16 { return r.RRType }
+
+func (r *Unknown) String() string {
+	if len(r.Data) == 0 {
+		return `\# 0`
+	}
+	return fmt.Sprintf(`\# %d %s`, len(r.Data), hex.EncodeToString(r.Data))
+}
+
+func (r *Unknown) encode(e *encoder) { e.write(r.Data) }
+
+// fqdn returns a domain name with the trailing dot used in presentation format
+func fqdn(domain string) string {
+	if strings.HasSuffix(domain, ".") {
+		return domain
+	}
+	return domain + "."
+}
+
+// quote returns a character string in presentation format, escaping quotes,
+// backslashes and non printable characters
+func quote(text string) string {
+	var s strings.Builder
+	s.WriteByte('"')
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '"' || c == '\\':
+			s.WriteByte('\\')
+			s.WriteByte(c)
+		case c < ' ' || c > '~':
+			s.WriteString(fmt.Sprintf("\\%03d", c))
+		default:
+			s.WriteByte(c)
+		}
+	}
+	s.WriteByte('"')
+	return s.String()
+}
+
+// rdataFromBytes decodes the RDATA of a resource record of the given type and length.
+// Domain names inside the data are decompressed using the whole packet.
+func rdataFromBytes(data []byte, offset *int, recordType uint16, length uint16) (RData, error) {
+	start := *offset
+	end := start + int(length)
+	if end > len(data) {
+		return nil, newDecodeError(ErrRDataOverrun, start)
+	}
+	// Names and fields must not be read past the end of the RDATA
+	rdata := data[:end]
+
+	var result RData
+	var err error
+	switch recordType {
+	case TypeA:
+		result, err = ipFromBytes(rdata, offset, net.IPv4len, func(ip net.IP) RData { return &A{IP: ip} })
+	case TypeAAAA:
+		result, err = ipFromBytes(rdata, offset, net.IPv6len, func(ip net.IP) RData { return &AAAA{IP: ip} })
+	case TypeNS:
+		var host string
+		host, err = rdataNameFromBytes(rdata, offset)
+		result = &NS{Host: host}
+	case TypeCNAME:
+		var target string
+		target, err = rdataNameFromBytes(rdata, offset)
+		result = &CNAME{Target: target}
+	case TypePTR:
+		var host string
+		host, err = rdataNameFromBytes(rdata, offset)
+		result = &PTR{Host: host}
+	case TypeMX:
+		result, err = mxFromBytes(rdata, offset)
+	case TypeSOA:
+		result, err = soaFromBytes(rdata, offset)
+	case TypeTXT:
+		result, err = txtFromBytes(rdata, offset)
+	case TypeSRV:
+		result, err = srvFromBytes(rdata, offset)
+	case TypeCAA:
+		result, err = caaFromBytes(rdata, offset)
+	case TypeOPT:
+		result, err = optFromBytes(rdata, offset)
+	default:
+		result = &Unknown{RRType: recordType, Data: copyBytes(rdata[start:end])}
+		*offset = end
+	}
+	if err != nil {
+		return nil, err
+	}
+	if *offset != end {
+		return nil, newDecodeError(ErrInvalidRData, start)
+	}
+	return result, nil
+}
+
+func ipFromBytes(data []byte, offset *int, size int, build func(net.IP) RData) (RData, error) {
+	if len(data)-*offset != size {
+		return nil, newDecodeError(ErrInvalidRData, *offset)
+	}
+	ip := net.IP(copyBytes(data[*offset:]))
+	*offset += size
+	return build(ip), nil
+}
+
+// rdataNameFromBytes decodes a domain name that must end within the RDATA
+func rdataNameFromBytes(data []byte, offset *int) (string, error) {
+	name, err := domainNameFromBytes(data, offset)
+	if errors.Is(err, ErrTruncatedName) {
+		return "", newDecodeError(ErrRDataOverrun, *offset)
+	}
+	return name, err
+}
+
+func mxFromBytes(data []byte, offset *int) (RData, error) {
+	preference, err := uint16FromBytes(data, offset)
+	if err != nil {
+		return nil, err
+	}
+	exchange, err := rdataNameFromBytes(data, offset)
+	if err != nil {
+		return nil, err
+	}
+	return &MX{Preference: preference, Exchange: exchange}, nil
+}
+
+func soaFromBytes(data []byte, offset *int) (RData, error) {
+	var err error
+	soa := &SOA{}
+	soa.MName, err = rdataNameFromBytes(data, offset)
+	if err != nil {
+		return nil, err
+	}
+	soa.RName, err = rdataNameFromBytes(data, offset)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range []*uint32{&soa.Serial, &soa.Refresh, &soa.Retry, &soa.Expire, &soa.Minimum} {
+		*field, err = uint32FromBytes(data, offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return soa, nil
+}
+
+func txtFromBytes(data []byte, offset *int) (RData, error) {
+	txt := &TXT{}
+	for *offset < len(data) {
+		text, err := characterStringFromBytes(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		txt.Texts = append(txt.Texts, text)
+	}
+	return txt, nil
+}
+
+func srvFromBytes(data []byte, offset *int) (RData, error) {
+	var err error
+	srv := &SRV{}
+	for _, field := range []*uint16{&srv.Priority, &srv.Weight, &srv.Port} {
+		*field, err = uint16FromBytes(data, offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	srv.Target, err = rdataNameFromBytes(data, offset)
+	if err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
+
+func caaFromBytes(data []byte, offset *int) (RData, error) {
+	if *offset >= len(data) {
+		return nil, newDecodeError(ErrRDataOverrun, *offset)
+	}
+	caa := &CAA{Flags: data[*offset]}
+	*offset++
+	tag, err := characterStringFromBytes(data, offset)
+	if err != nil {
+		return nil, err
+	}
+	caa.Tag = tag
+	caa.Value = string(data[*offset:])
+	*offset = len(data)
+	return caa, nil
+}
+
+func uint16FromBytes(data []byte, offset *int) (uint16, error) {
+	if *offset+2 > len(data) {
+		return 0, newDecodeError(ErrRDataOverrun, *offset)
+	}
+	value := binary.BigEndian.Uint16(data[*offset : *offset+2])
+	*offset += 2
+	return value, nil
+}
+
+func uint32FromBytes(data []byte, offset *int) (uint32, error) {
+	if *offset+4 > len(data) {
+		return 0, newDecodeError(ErrRDataOverrun, *offset)
+	}
+	value := binary.BigEndian.Uint32(data[*offset : *offset+4])
+	*offset += 4
+	return value, nil
+}
+
+// characterStringFromBytes decodes a length prefixed character string
+// https://www.rfc-editor.org/rfc/rfc1035#section-3.3
+func characterStringFromBytes(data []byte, offset *int) (string, error) {
+	if *offset >= len(data) {
+		return "", newDecodeError(ErrRDataOverrun, *offset)
+	}
+	length := int(data[*offset])
+	if *offset+1+length > len(data) {
+		return "", newDecodeError(ErrRDataOverrun, *offset)
+	}
+	text := string(data[*offset+1 : *offset+1+length])
+	*offset += 1 + length
+	return text, nil
+}
+
+func copyBytes(data []byte) []byte {
+	result := make([]byte, len(data))
+	copy(result, data)
+	return result
+}
@@ -0,0 +1,151 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestRDataRoundTrip(t *testing.T) {
+	tests := []struct {
+		data     RData
+		expected string
+	}{
+		{&A{IP: net.IPv4(8, 8, 8, 8)}, "8.8.8.8"},
+		{&AAAA{IP: net.ParseIP("2001:db8::1")}, "2001:db8::1"},
+		{&NS{Host: "ns1.abc.com"}, "ns1.abc.com."},
+		{&CNAME{Target: "www.abc.com"}, "www.abc.com."},
+		{&PTR{Host: "abc.com"}, "abc.com."},
+		{&MX{Preference: 10, Exchange: "mail.abc.com"}, "10 mail.abc.com."},
+		{
+			&SOA{MName: "ns1.abc.com", RName: "admin.abc.com", Serial: 1, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300},
+			"ns1.abc.com. admin.abc.com. 1 7200 3600 1209600 300",
+		},
+		{&TXT{Texts: []string{"v=spf1 -all", `say "hi"`}}, `"v=spf1 -all" "say \"hi\""`},
+		{&SRV{Priority: 10, Weight: 5, Port: 5060, Target: "sip.abc.com"}, "10 5 5060 sip.abc.com."},
+		{&CAA{Flags: 0, Tag: "issue", Value: "letsencrypt.org"}, `0 issue "letsencrypt.org"`},
+		{&Unknown{RRType: 65280, Data: []byte{0x0a, 0x00, 0x00, 0x01}}, `\# 4 0a000001`},
+	}
+	for _, test := range tests {
+		t.Run(TypeToString(test.data.Type()), func(t *testing.T) {
+			message := &Message{
+				Header: &Header{ID: 1, IsResponse: true},
+				Questions: []*Question{
+					{Name: "abc.com", Type: test.data.Type(), Class: ClassINET},
+				},
+				Answers: []*Answer{
+					{Name: "abc.com", Type: test.data.Type(), Class: ClassINET, TTL: 60, Data: test.data},
+				},
+			}
+			decoded, err := FromBytes(message.Bytes())
+			if err != nil {
+				t.Fatal("Failed to decode message:", err)
+			}
+			data := decoded.Answers[0].Data
+			if data.Type() != test.data.Type() {
+				t.Errorf("Expected type %d, got %d", test.data.Type(), data.Type())
+			}
+			if data.String() != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, data.String())
+			}
+		})
+	}
+}
+
+func TestDecodeCompressedRData(t *testing.T) {
+	packet := []byte{
+		0x00, 0x01, // ID
+		0x81, 0x00, // Flags
+		0x00, 0x00, // Question count
+		0x00, 0x02, // Answer count
+		0x00, 0x00, // Authority count
+		0x00, 0x00, // Additional count
+		0x03, 0x77, 0x77, 0x77, // www
+		0x03, 0x61, 0x62, 0x63, // abc
+		0x03, 0x63, 0x6f, 0x6d, // com
+		0x00,       // End of domain name
+		0x00, 0x05, // Type CNAME
+		0x00, 0x01, // Class
+		0x00, 0x00, 0x00, 0x3c, // TTL
+		0x00, 0x06, // Length
+		0x03, 0x77, 0x65, 0x62, // web
+		0xc0, 0x10, // Pointer to abc.com
+		0xc0, 0x23, // Pointer to web.abc.com
+		0x00, 0x01, // Type A
+		0x00, 0x01, // Class
+		0x00, 0x00, 0x00, 0x3c, // TTL
+		0x00, 0x04, // Length
+		0x01, 0x02, 0x03, 0x04, // Data
+	}
+	message, err := FromBytes(packet)
+	if err != nil {
+		t.Fatal("Failed to decode message:", err)
+	}
+	cname, ok := message.Answers[0].Data.(*CNAME)
+	if !ok || cname.Target != "web.abc.com" {
+		t.Errorf("Failed to decompress CNAME target: %v", message.Answers[0].Data)
+	}
+	if message.Answers[1].Name != "web.abc.com" {
+		t.Errorf("Failed to decode pointer into RDATA: %s", message.Answers[1].Name)
+	}
+
+	// The CNAME target must be compressed again when encoding
+	if encoded := message.Bytes(); !bytes.Equal(encoded, packet) {
+		t.Errorf("Failed to encode compressed RDATA\nexpected % x\ngot      % x", packet, encoded)
+	}
+}
+
+func TestDecodeInvalidRData(t *testing.T) {
+	packet := []byte{
+		0x00, 0x01, // ID
+		0x81, 0x00, // Flags
+		0x00, 0x00, // Question count
+		0x00, 0x01, // Answer count
+		0x00, 0x00, // Authority count
+		0x00, 0x00, // Additional count
+		0x00,       // Root domain name
+		0x00, 0x01, // Type A
+		0x00, 0x01, // Class
+		0x00, 0x00, 0x00, 0x3c, // TTL
+		0x00, 0x03, // Length
+		0x01, 0x02, 0x03, // Data
+	}
+	if _, err := FromBytes(packet); !errors.Is(err, ErrInvalidRData) {
+		t.Errorf("Expected %v, got %v", ErrInvalidRData, err)
+	}
+}
+
+func TestNewAddressRecords(t *testing.T) {
+	tests := []struct {
+		name     string
+		ip       net.IP
+		a, aaaa  bool
+		expected string
+	}{
+		{"IPv4", net.IPv4(192, 0, 2, 1), true, false, "192.0.2.1"},
+		{"IPv4 in 4 bytes", net.IP{192, 0, 2, 1}, true, false, "192.0.2.1"},
+		{"IPv6", net.ParseIP("2001:db8::1"), false, true, "2001:db8::1"},
+		{"IPv4 mapped to IPv6", net.ParseIP("::ffff:192.0.2.1"), true, false, "192.0.2.1"},
+		{"nil", nil, false, false, ""},
+		{"wrong length", net.IP{192, 0, 2}, false, false, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, err := NewA(test.ip)
+			if (err == nil) != test.a {
+				t.Errorf("Expected A to succeed %t, got %v", test.a, err)
+			}
+			if err == nil && (a.String() != test.expected || len(a.IP) != net.IPv4len) {
+				t.Errorf("Expected A %s in 4 bytes, got %v", test.expected, a.IP)
+			}
+			aaaa, err := NewAAAA(test.ip)
+			if (err == nil) != test.aaaa {
+				t.Errorf("Expected AAAA to succeed %t, got %v", test.aaaa, err)
+			}
+			if err == nil && aaaa.String() != test.expected {
+				t.Errorf("Expected AAAA %s, got %v", test.expected, aaaa.IP)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package resolver
+
+import (
+	"container/list"
+	msg "github.com/rodweb/dns/internal/message"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheKey identifies a cached response, names are compared case insensitively
+type cacheKey struct {
+	name   string
+	rrType uint16
+	class  uint16
+}
+
+func newCacheKey(question *msg.Question) cacheKey {
+	return cacheKey{
+		name:   strings.ToLower(strings.TrimSuffix(question.Name, ".")),
+		rrType: question.Type,
+		class:  question.Class,
+	}
+}
+
+type cacheEntry struct {
+	key      cacheKey
+	response *msg.Message
+	stored   time.Time
+	// ttl is how long the response stays valid, the lowest TTL of its records
+	ttl time.Duration
+	// prefetching is set once the entry was handed out for a refresh
+	prefetching bool
+}
+
+// cache is a size bounded cache of responses to single questions.
+// The least recently used response is evicted when it is full.
+type cache struct {
+	maxEntries int
+	// prefetchAfter is the fraction of its TTL after which an entry should be refreshed, 0 disables it
+	prefetchAfter float64
+	// maxStale is how long expired entries are kept to be served when a refresh fails
+	maxStale time.Duration
+	// now is the clock, replaced by tests
+	now func() time.Time
+
+	mutex   sync.Mutex
+	entries map[cacheKey]*list.Element
+	// lru holds the entries, most recently used first
+	lru *list.List
+}
+
+func newCache(maxEntries int) *cache {
+	return &cache{
+		maxEntries: maxEntries,
+		now:        time.Now,
+		entries:    make(map[cacheKey]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// get returns a copy of a cached response, with its TTLs decreased by the time it spent in the cache.
+// prefetch is true for the first get past the prefetch fraction of the TTL, the caller should refresh the entry.
+func (c *cache) get(key cacheKey) (response *msg.Message, prefetch bool, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false, false
+	}
+	entry := element.Value.(*cacheEntry)
+	age := c.now().Sub(entry.stored)
+	if age >= entry.ttl {
+		// Expired entries are kept a while longer, in case they have to be served stale
+		if age >= entry.ttl+c.maxStale {
+			c.remove(element)
+		}
+		return nil, false, false
+	}
+	c.lru.MoveToFront(element)
+	if c.prefetchAfter > 0 && !entry.prefetching && float64(age) >= c.prefetchAfter*float64(entry.ttl) {
+		entry.prefetching = true
+		prefetch = true
+	}
+	return copyResponse(entry.response, uint32(age/time.Second)), prefetch, true
+}
+
+// getStale returns a copy of an expired response still within maxStale, with every TTL set to ttl
+func (c *cache) getStale(key cacheKey, ttl uint32) (*msg.Message, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	age := c.now().Sub(entry.stored)
+	if age < entry.ttl || age >= entry.ttl+c.maxStale {
+		return nil, false
+	}
+	response := copyResponse(entry.response, 0)
+	for _, section := range [][]*msg.Answer{response.Answers, response.Authority, response.Additional} {
+		for _, record := range section {
+			if record.Type != msg.TypeOPT {
+				record.TTL = ttl
+			}
+		}
+	}
+	return response, true
+}
+
+// set stores a response for ttl, replacing any previous response to the same question
+func (c *cache) set(key cacheKey, response *msg.Message, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry := &cacheEntry{
+		key:      key,
+		response: copyResponse(response, 0),
+		stored:   c.now(),
+		ttl:      ttl,
+	}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// len returns the number of cached responses, expired ones included until they are looked up or evicted
+func (c *cache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lru.Len()
+}
+
+func (c *cache) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry).key)
+}
+
+// copyResponse copies the header and records of a response, decreasing every TTL by age seconds.
+// RDATA is shared, it is never modified once decoded.
+func copyResponse(response *msg.Message, age uint32) *msg.Message {
+	header := *response.Header
+	copyRecords := func(records []*msg.Answer) []*msg.Answer {
+		if records == nil {
+			return nil
+		}
+		copied := make([]*msg.Answer, len(records))
+		for i, record := range records {
+			answer := *record
+			if answer.Type != msg.TypeOPT {
+				if answer.TTL > age {
+					answer.TTL -= age
+				} else {
+					answer.TTL = 0
+				}
+			}
+			copied[i] = &answer
+		}
+		return copied
+	}
+	questions := make([]*msg.Question, len(response.Questions))
+	for i, question := range response.Questions {
+		copied := *question
+		questions[i] = &copied
+	}
+	return &msg.Message{
+		Header:     &header,
+		Questions:  questions,
+		Answers:    copyRecords(response.Answers),
+		Authority:  copyRecords(response.Authority),
+		Additional: copyRecords(response.Additional),
+	}
+}
@@ -0,0 +1,95 @@
+package resolver
+
+import (
+	msg "github.com/rodweb/dns/internal/message"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a cache clock moved by hand
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestCache(maxEntries int) (*cache, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	c := newCache(maxEntries)
+	c.now = clock.Now
+	return c, clock
+}
+
+func newCachedResponse(name string, ttl uint32) *msg.Message {
+	question := &msg.Question{Name: name, Type: msg.TypeA, Class: msg.ClassINET}
+	return &msg.Message{
+		Header:    &msg.Header{IsResponse: true},
+		Questions: []*msg.Question{question},
+		Answers: []*msg.Answer{
+			{Name: name, Type: msg.TypeA, Class: msg.ClassINET, TTL: ttl, Data: &msg.A{IP: net.IPv4(10, 0, 0, 1)}},
+		},
+	}
+}
+
+func cacheKeyOf(name string) cacheKey {
+	return newCacheKey(&msg.Question{Name: name, Type: msg.TypeA, Class: msg.ClassINET})
+}
+
+func TestCacheTTLDecay(t *testing.T) {
+	c, clock := newTestCache(10)
+	c.set(cacheKeyOf("abc.test"), newCachedResponse("abc.test", 60), 60*time.Second)
+
+	clock.Advance(25 * time.Second)
+	response, _, ok := c.get(cacheKeyOf("ABC.test."))
+	if !ok {
+		t.Fatal("Expected a case insensitive hit")
+	}
+	if ttl := response.Answers[0].TTL; ttl != 35 {
+		t.Errorf("Expected TTL 35, got %d", ttl)
+	}
+
+	// The returned copy does not change the cached response
+	response.Answers[0].TTL = 1000
+	if response, _, _ = c.get(cacheKeyOf("abc.test")); response.Answers[0].TTL != 35 {
+		t.Errorf("Expected the cached TTL to be untouched, got %d", response.Answers[0].TTL)
+	}
+
+	clock.Advance(35 * time.Second)
+	if _, _, ok := c.get(cacheKeyOf("abc.test")); ok {
+		t.Error("Expected the response to expire")
+	}
+	if c.len() != 0 {
+		t.Errorf("Expected the expired response to be removed, %d left", c.len())
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c, _ := newTestCache(2)
+	c.set(cacheKeyOf("a.test"), newCachedResponse("a.test", 60), time.Minute)
+	c.set(cacheKeyOf("b.test"), newCachedResponse("b.test", 60), time.Minute)
+	c.get(cacheKeyOf("a.test"))
+	c.set(cacheKeyOf("c.test"), newCachedResponse("c.test", 60), time.Minute)
+
+	if _, _, ok := c.get(cacheKeyOf("b.test")); ok {
+		t.Error("Expected the least recently used response to be evicted")
+	}
+	if _, _, ok := c.get(cacheKeyOf("a.test")); !ok {
+		t.Error("Expected the recently used response to be kept")
+	}
+	if c.len() != 2 {
+		t.Errorf("Expected 2 responses, got %d", c.len())
+	}
+}
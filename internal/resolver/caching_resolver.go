@@ -0,0 +1,367 @@
+package resolver
+
+import (
+	"context"
+	msg "github.com/rodweb/dns/internal/message"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for the zero values of CacheOptions
+const (
+	DefaultCacheSize   = 10000
+	DefaultCacheMaxTTL = 24 * time.Hour
+	// DefaultNegativeMaxTTL is the upper bound RFC 2308 recommends for negative answers
+	DefaultNegativeMaxTTL = 3 * time.Hour
+	// DefaultPrefetchFraction refreshes entries queried during the last 10% of their TTL
+	DefaultPrefetchFraction = 0.9
+	// DefaultMaxStale is within the 1 to 3 days RFC 8767 suggests
+	DefaultMaxStale = 24 * time.Hour
+	// DefaultStaleAnswerTimeout is the client response timer RFC 8767 recommends
+	DefaultStaleAnswerTimeout = 1800 * time.Millisecond
+)
+
+// staleAnswerTTL is the TTL of expired records served when the upstreams fail, as RFC 8767 recommends
+const staleAnswerTTL = 30
+
+// CacheOptions tunes how responses are cached
+type CacheOptions struct {
+	// Size is the number of responses kept, the least recently used are evicted first
+	Size int
+	// MinTTL raises the TTL of records that would expire sooner
+	MinTTL time.Duration
+	// MaxTTL lowers the TTL of records that would be kept longer
+	MaxTTL time.Duration
+	// NegativeMaxTTL caps how long a name or type that does not exist is remembered
+	NegativeMaxTTL time.Duration
+	// PrefetchFraction is the fraction of its TTL after which a query refreshes an entry in the background.
+	// A negative fraction disables prefetching.
+	PrefetchFraction float64
+	// MaxStale is how long expired entries may be served when the upstreams fail.
+	// A negative duration disables serving stale data.
+	MaxStale time.Duration
+	// StaleAnswerTimeout is how long a refresh may take before expired entries are served, the refresh
+	// going on in the background. A negative duration waits for the refresh to fail.
+	StaleAnswerTimeout time.Duration
+}
+
+func (o CacheOptions) withDefaults() CacheOptions {
+	if o.Size <= 0 {
+		o.Size = DefaultCacheSize
+	}
+	if o.MaxTTL <= 0 {
+		o.MaxTTL = DefaultCacheMaxTTL
+	}
+	if o.MinTTL > o.MaxTTL {
+		o.MinTTL = o.MaxTTL
+	}
+	if o.NegativeMaxTTL <= 0 {
+		o.NegativeMaxTTL = DefaultNegativeMaxTTL
+	}
+	if o.PrefetchFraction == 0 {
+		o.PrefetchFraction = DefaultPrefetchFraction
+	} else if o.PrefetchFraction < 0 || o.PrefetchFraction >= 1 {
+		o.PrefetchFraction = 0
+	}
+	if o.MaxStale == 0 {
+		o.MaxStale = DefaultMaxStale
+	} else if o.MaxStale < 0 {
+		o.MaxStale = 0
+	}
+	if o.StaleAnswerTimeout == 0 {
+		o.StaleAnswerTimeout = DefaultStaleAnswerTimeout
+	} else if o.StaleAnswerTimeout < 0 {
+		o.StaleAnswerTimeout = 0
+	}
+	return o
+}
+
+// CacheStats counts how questions were answered by a CachingResolver
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+	// NegativeEntries is the number of cached NXDOMAIN and NODATA answers
+	NegativeEntries int
+	// Prefetches is the number of entries refreshed before they expired
+	Prefetches uint64
+	// Stale is the number of questions answered with expired data because the upstreams failed or were too slow
+	Stale uint64
+}
+
+// CachingResolver answers questions from the responses previously given by the next resolver.
+// Negative answers are cached apart, as described by RFC 2308, so they cannot evict positive ones.
+type CachingResolver struct {
+	next     Resolver
+	options  CacheOptions
+	cache    *cache
+	negative *cache
+
+	hits       uint64
+	misses     uint64
+	prefetches uint64
+	stale      uint64
+}
+
+// NewCachingResolver creates a cache in front of next.
+// Zero values in options are replaced by their defaults.
+func NewCachingResolver(next Resolver, options CacheOptions) *CachingResolver {
+	options = options.withDefaults()
+	r := &CachingResolver{
+		next:     next,
+		options:  options,
+		cache:    newCache(options.Size),
+		negative: newCache(options.Size),
+	}
+	for _, c := range []*cache{r.cache, r.negative} {
+		c.prefetchAfter = options.PrefetchFraction
+		c.maxStale = options.MaxStale
+	}
+	return r
+}
+
+// Stats returns the hit and miss counts of the cache
+func (r *CachingResolver) Stats() CacheStats {
+	return CacheStats{
+		Hits:            atomic.LoadUint64(&r.hits),
+		Misses:          atomic.LoadUint64(&r.misses),
+		Entries:         r.cache.len(),
+		NegativeEntries: r.negative.len(),
+		Prefetches:      atomic.LoadUint64(&r.prefetches),
+		Stale:           atomic.LoadUint64(&r.stale),
+	}
+}
+
+// Resolve answers each question from the cache, asking the next resolver the ones that are not cached.
+// Popular entries are refreshed before they expire, and expired entries are served when the next resolver fails
+// or does not answer within StaleAnswerTimeout.
+func (r *CachingResolver) Resolve(ctx context.Context, request *msg.Message) (*msg.Message, error) {
+	var wg sync.WaitGroup
+	responses := make([]*msg.Message, len(request.Questions))
+	errs := make([]error, len(request.Questions))
+
+	for i, question := range request.Questions {
+		if cached, prefetch, ok := r.lookup(question); ok {
+			atomic.AddUint64(&r.hits, 1)
+			if prefetch {
+				go r.prefetch(request, question)
+			}
+			// The cached response may have been asked with another case
+			restoreCase(cached, question.Name)
+			responses[i] = cached
+			continue
+		}
+		atomic.AddUint64(&r.misses, 1)
+
+		wg.Add(1)
+		go func(i int, question *msg.Question) {
+			defer wg.Done()
+			responses[i], errs[i] = r.resolveOrStale(ctx, request, question)
+		}(i, question)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mergeResponses(request, responses), nil
+}
+
+// resolve asks the next resolver a single question and caches its response
+func (r *CachingResolver) resolve(ctx context.Context, request *msg.Message, question *msg.Question) (*msg.Message, error) {
+	header := *request.Header
+	header.QuestionCount = 1
+	response, err := r.next.Resolve(ctx, &msg.Message{
+		Header:     &header,
+		Questions:  []*msg.Question{question},
+		Additional: request.Additional,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Truncated answers are incomplete, and failures should be retried
+	if response.Header.Truncated {
+		return response, nil
+	}
+	switch code := response.Header.ResponseCode; {
+	case code == msg.Succeeded && len(response.Answers) > 0:
+		ttl := r.clampTTLs(response)
+		if ttl > 0 {
+			r.cache.set(newCacheKey(question), response, ttl)
+		}
+	case code == msg.Succeeded || code == msg.NameError:
+		ttl, ok := r.negativeTTL(response)
+		if !ok {
+			break
+		}
+		key := newCacheKey(question)
+		if code == msg.NameError {
+			if len(response.Answers) == 0 {
+				// A name that does not exist has no records of any type
+				key.rrType = anyType
+			} else {
+				// The name asked is an alias, only the final target of its chain does not exist
+				target := chainTarget(response.Answers, question.Name)
+				targetQuestion := &msg.Question{Name: target, Type: question.Type, Class: question.Class}
+				targetKey := newCacheKey(targetQuestion)
+				targetKey.rrType = anyType
+				r.negative.set(targetKey, &msg.Message{
+					Header:    response.Header,
+					Questions: []*msg.Question{targetQuestion},
+					Authority: response.Authority,
+				}, ttl)
+			}
+		}
+		r.negative.set(key, response, ttl)
+	}
+	return response, nil
+}
+
+// resolveOrStale asks the next resolver a question that has expired data, answering with it when the next
+// resolver fails or is slower than StaleAnswerTimeout. A slow refresh still updates the cache once it is done.
+func (r *CachingResolver) resolveOrStale(ctx context.Context, request *msg.Message, question *msg.Question) (*msg.Message, error) {
+	stale, ok := r.lookupStale(question)
+	if !ok || r.options.StaleAnswerTimeout == 0 {
+		response, err := r.resolve(ctx, request, question)
+		if !ok || err != nil || response.Header.ResponseCode != msg.ServerFailure {
+			return response, err
+		}
+		return r.serveStale(stale, question), nil
+	}
+
+	// The refresh outlives the request once the stale data is answered, as a prefetch does
+	refreshed := make(chan *msg.Message, 1)
+	go func() {
+		response, err := r.resolve(context.Background(), request, question)
+		if err != nil {
+			log.Printf("Failed to refresh %s: %s\n", question.Name, err)
+		}
+		refreshed <- response
+	}()
+	timer := time.NewTimer(r.options.StaleAnswerTimeout)
+	defer timer.Stop()
+	select {
+	case response := <-refreshed:
+		if response != nil && response.Header.ResponseCode != msg.ServerFailure {
+			return response, nil
+		}
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return r.serveStale(stale, question), nil
+}
+
+// serveStale counts an expired response answered to a question
+func (r *CachingResolver) serveStale(stale *msg.Message, question *msg.Question) *msg.Message {
+	atomic.AddUint64(&r.stale, 1)
+	restoreCase(stale, question.Name)
+	return stale
+}
+
+// chainTarget returns the name the CNAME chain in answers leads to from name, name itself without CNAME
+func chainTarget(answers []*msg.Answer, name string) string {
+	// Each link is followed at most once, so that a loop ends
+	for range answers {
+		next := ""
+		for _, answer := range answers {
+			if cname, ok := answer.Data.(*msg.CNAME); ok && sameName(answer.Name, name) {
+				next = cname.Target
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+	return name
+}
+
+// anyType stands for every type in the key of a cached NXDOMAIN
+const anyType = 0
+
+// lookup returns the cached response to a question, positive or negative, and whether to prefetch it
+func (r *CachingResolver) lookup(question *msg.Question) (*msg.Message, bool, bool) {
+	key := newCacheKey(question)
+	if cached, prefetch, ok := r.cache.get(key); ok {
+		return cached, prefetch, true
+	}
+	if cached, prefetch, ok := r.negative.get(key); ok {
+		return cached, prefetch, true
+	}
+	key.rrType = anyType
+	return r.negative.get(key)
+}
+
+// lookupStale returns the expired response to a question, for when it cannot be refreshed
+func (r *CachingResolver) lookupStale(question *msg.Question) (*msg.Message, bool) {
+	key := newCacheKey(question)
+	if stale, ok := r.cache.getStale(key, staleAnswerTTL); ok {
+		return stale, true
+	}
+	if stale, ok := r.negative.getStale(key, staleAnswerTTL); ok {
+		return stale, true
+	}
+	key.rrType = anyType
+	return r.negative.getStale(key, staleAnswerTTL)
+}
+
+// prefetch refreshes a cached response before it expires, so that popular names never miss.
+// It outlives the request that triggered it.
+func (r *CachingResolver) prefetch(request *msg.Message, question *msg.Question) {
+	atomic.AddUint64(&r.prefetches, 1)
+	if _, err := r.resolve(context.Background(), request, question); err != nil {
+		log.Printf("Failed to prefetch %s: %s\n", question.Name, err)
+	}
+}
+
+// negativeTTL returns how long an NXDOMAIN or NODATA response can be cached.
+// RFC 2308 takes it from the SOA in the authority section, the lower of its TTL and its MINIMUM field.
+// Without an SOA the response is not cached. The SOA TTL is lowered to match, as it is served again.
+func (r *CachingResolver) negativeTTL(response *msg.Message) (time.Duration, bool) {
+	for _, record := range response.Authority {
+		soa, ok := record.Data.(*msg.SOA)
+		if !ok {
+			continue
+		}
+		ttl := record.TTL
+		if soa.Minimum < ttl {
+			ttl = soa.Minimum
+		}
+		if maxTTL := uint32(r.options.NegativeMaxTTL / time.Second); ttl > maxTTL {
+			ttl = maxTTL
+		}
+		record.TTL = ttl
+		return time.Duration(ttl) * time.Second, ttl > 0
+	}
+	return 0, false
+}
+
+// clampTTLs applies MinTTL and MaxTTL to the records of a response and returns the lowest TTL
+func (r *CachingResolver) clampTTLs(response *msg.Message) time.Duration {
+	minTTL := uint32(r.options.MinTTL / time.Second)
+	maxTTL := uint32(r.options.MaxTTL / time.Second)
+	lowest := maxTTL
+	for _, section := range [][]*msg.Answer{response.Answers, response.Authority, response.Additional} {
+		for _, record := range section {
+			if record.Type == msg.TypeOPT {
+				continue
+			}
+			if record.TTL < minTTL {
+				record.TTL = minTTL
+			}
+			if record.TTL > maxTTL {
+				record.TTL = maxTTL
+			}
+			if record.TTL < lowest {
+				lowest = record.TTL
+			}
+		}
+	}
+	return time.Duration(lowest) * time.Second
+}
@@ -0,0 +1,404 @@
+package resolver
+
+import (
+	"context"
+	msg "github.com/rodweb/dns/internal/message"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCachingResolverCountsHitsAndMisses(t *testing.T) {
+	next := &staticResolver{ip: net.IPv4(10, 0, 0, 1)}
+	resolver := NewCachingResolver(next, CacheOptions{})
+
+	question := func(name string) *msg.Question {
+		return &msg.Question{Name: name, Type: msg.TypeA, Class: msg.ClassINET}
+	}
+	for _, query := range []*msg.Message{
+		newQuery(question("a.test")),
+		newQuery(question("A.TEST"), question("b.test")),
+		newQuery(question("b.test")),
+	} {
+		response, err := resolver.Resolve(context.Background(), query)
+		if err != nil {
+			t.Fatal("Failed to resolve:", err)
+		}
+		if len(response.Answers) != len(query.Questions) {
+			t.Fatalf("Expected an answer per question, got %v", response.Answers)
+		}
+		for i, answer := range response.Answers {
+			if answer.Name != query.Questions[i].Name {
+				t.Errorf("Expected the answer for %s, got %s", query.Questions[i].Name, answer.Name)
+			}
+		}
+	}
+
+	if len(next.questions) != 2 {
+		t.Errorf("Expected 2 questions to reach the next resolver, got %v", next.questions)
+	}
+	if stats := resolver.Stats(); stats.Hits != 2 || stats.Misses != 2 || stats.Entries != 2 {
+		t.Errorf("Expected 2 hits, 2 misses and 2 entries, got %+v", stats)
+	}
+}
+
+func TestCachingResolverClampsTTL(t *testing.T) {
+	next := &staticResolver{ip: net.IPv4(10, 0, 0, 1)}
+	tests := []struct {
+		options CacheOptions
+		ttl     uint32
+	}{
+		{CacheOptions{MinTTL: 5 * time.Minute}, 300},
+		{CacheOptions{MaxTTL: 30 * time.Second}, 30},
+		{CacheOptions{}, 60},
+	}
+	for _, test := range tests {
+		resolver := NewCachingResolver(next, test.options)
+		for i := 0; i < 2; i++ {
+			response, err := resolver.Resolve(context.Background(), newQuery(
+				&msg.Question{Name: "abc.test", Type: msg.TypeA, Class: msg.ClassINET},
+			))
+			if err != nil {
+				t.Fatal("Failed to resolve:", err)
+			}
+			if ttl := response.Answers[0].TTL; ttl != test.ttl {
+				t.Errorf("Expected TTL %d with %+v, got %d", test.ttl, test.options, ttl)
+			}
+		}
+	}
+}
+
+func TestCachingResolverSkipsFailures(t *testing.T) {
+	resolver, err := NewForwardingResolver([]string{startUpstream(t, answerZone)}, ForwardingOptions{
+		AttemptTimeout: 50 * time.Millisecond,
+		Retries:        -1,
+	})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+	caching := NewCachingResolver(resolver, CacheOptions{})
+
+	for i := 0; i < 2; i++ {
+		response, err := caching.Resolve(context.Background(), newQuery(
+			&msg.Question{Name: "silent.test", Type: msg.TypeA, Class: msg.ClassINET},
+		))
+		if err != nil {
+			t.Fatal("Failed to resolve:", err)
+		}
+		if response.Header.ResponseCode != msg.ServerFailure {
+			t.Errorf("Expected SERVFAIL, got RCODE %d", response.Header.ResponseCode)
+		}
+	}
+	if stats := caching.Stats(); stats.Misses != 2 || stats.Entries != 0 {
+		t.Errorf("Expected failures not to be cached, got %+v", stats)
+	}
+}
+
+func TestCachingResolverSkipsTruncated(t *testing.T) {
+	// A partial answer that did not fit over UDP, and no TCP to get the rest
+	var received int32
+	answer := answerA(net.IPv4(10, 0, 0, 1))
+	upstream := startUpstream(t, func(request *msg.Message) *msg.Message {
+		atomic.AddInt32(&received, 1)
+		response := answer(request)
+		response.Header.Truncated = true
+		return response
+	})
+	resolver, err := NewForwardingResolver([]string{upstream}, ForwardingOptions{
+		AttemptTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+	caching := NewCachingResolver(resolver, CacheOptions{})
+
+	for i := 0; i < 2; i++ {
+		response := resolveA(t, caching, "large.test")
+		if !response.Header.Truncated {
+			t.Error("Expected the answer to stay truncated")
+		}
+	}
+	if stats := caching.Stats(); stats.Hits != 0 || stats.Entries != 0 {
+		t.Errorf("Expected truncated answers not to be cached, got %+v", stats)
+	}
+	if attempts := atomic.LoadInt32(&received); attempts != 2 {
+		t.Errorf("Expected both queries to reach the upstream, got %d", attempts)
+	}
+}
+
+func TestCachingResolverCachesNegativeAnswers(t *testing.T) {
+	var received int32
+	upstream := startUpstream(t, func(request *msg.Message) *msg.Message {
+		atomic.AddInt32(&received, 1)
+		return answerZone(request)
+	})
+	resolver, err := NewForwardingResolver([]string{upstream}, ForwardingOptions{})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+	caching := NewCachingResolver(resolver, CacheOptions{})
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	caching.cache.now = clock.Now
+	caching.negative.now = clock.Now
+
+	resolve := func(name string, recordType uint16, code msg.ResponseCode) *msg.Message {
+		t.Helper()
+		response, err := caching.Resolve(context.Background(), newQuery(
+			&msg.Question{Name: name, Type: recordType, Class: msg.ClassINET},
+		))
+		if err != nil {
+			t.Fatal("Failed to resolve:", err)
+		}
+		if response.Header.ResponseCode != code {
+			t.Errorf("Expected RCODE %d for %s, got %d", code, name, response.Header.ResponseCode)
+		}
+		return response
+	}
+	expectUpstreamQueries := func(expected int32) {
+		t.Helper()
+		if queries := atomic.LoadInt32(&received); queries != expected {
+			t.Errorf("Expected %d upstream queries, got %d", expected, queries)
+		}
+	}
+
+	resolve("missing.test", msg.TypeA, msg.NameError)
+	clock.Advance(10 * time.Second)
+	response := resolve("missing.test", msg.TypeA, msg.NameError)
+	// The SOA TTL is its minimum of 30, minus the time spent in cache
+	if len(response.Authority) != 1 || response.Authority[0].Type != msg.TypeSOA || response.Authority[0].TTL != 20 {
+		t.Errorf("Expected the SOA with TTL 20, got %v", response.Authority)
+	}
+	// NXDOMAIN covers every type of the name
+	resolve("missing.test", msg.TypeMX, msg.NameError)
+	expectUpstreamQueries(1)
+
+	resolve("nodata.test", msg.TypeA, msg.Succeeded)
+	resolve("nodata.test", msg.TypeA, msg.Succeeded)
+	expectUpstreamQueries(2)
+	// NODATA only covers the type asked for
+	resolve("nodata.test", msg.TypeMX, msg.Succeeded)
+	expectUpstreamQueries(3)
+
+	clock.Advance(30 * time.Second)
+	resolve("missing.test", msg.TypeA, msg.NameError)
+	expectUpstreamQueries(4)
+
+	if stats := caching.Stats(); stats.Entries != 0 || stats.NegativeEntries != 3 {
+		t.Errorf("Expected only negative entries, got %+v", stats)
+	}
+}
+
+func TestCachingResolverCachesNegativeCNAMETargets(t *testing.T) {
+	var received int32
+	upstream := startUpstream(t, func(request *msg.Message) *msg.Message {
+		atomic.AddInt32(&received, 1)
+		return answerZone(request)
+	})
+	resolver, err := NewForwardingResolver([]string{upstream}, ForwardingOptions{})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+	caching := NewCachingResolver(resolver, CacheOptions{})
+
+	resolve := func(name string, recordType uint16, code msg.ResponseCode, answers int) {
+		t.Helper()
+		response, err := caching.Resolve(context.Background(), newQuery(
+			&msg.Question{Name: name, Type: recordType, Class: msg.ClassINET},
+		))
+		if err != nil {
+			t.Fatal("Failed to resolve:", err)
+		}
+		if response.Header.ResponseCode != code || len(response.Answers) != answers {
+			t.Errorf("Expected RCODE %d with %d answers for %s %s, got RCODE %d with %v",
+				code, answers, name, msg.TypeToString(recordType), response.Header.ResponseCode, response.Answers)
+		}
+	}
+
+	resolve("dangling.test", msg.TypeA, msg.NameError, 1)
+	resolve("dangling.test", msg.TypeA, msg.NameError, 1)
+	// The target does not exist, whatever the type
+	resolve("gone.test", msg.TypeA, msg.NameError, 0)
+	resolve("gone.test", msg.TypeMX, msg.NameError, 0)
+	if queries := atomic.LoadInt32(&received); queries != 1 {
+		t.Errorf("Expected 1 upstream query, got %d", queries)
+	}
+
+	// The alias itself exists
+	resolve("dangling.test", msg.TypeCNAME, msg.Succeeded, 1)
+	if queries := atomic.LoadInt32(&received); queries != 2 {
+		t.Errorf("Expected the CNAME to be asked upstream, got %d queries", queries)
+	}
+}
+
+func TestCachingResolverCapsNegativeTTL(t *testing.T) {
+	resolver, err := NewForwardingResolver([]string{startUpstream(t, answerZone)}, ForwardingOptions{})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+	caching := NewCachingResolver(resolver, CacheOptions{NegativeMaxTTL: 10 * time.Second})
+
+	for i := 0; i < 2; i++ {
+		response, err := caching.Resolve(context.Background(), newQuery(
+			&msg.Question{Name: "missing.test", Type: msg.TypeA, Class: msg.ClassINET},
+		))
+		if err != nil {
+			t.Fatal("Failed to resolve:", err)
+		}
+		if len(response.Authority) != 1 || response.Authority[0].TTL != 10 {
+			t.Errorf("Expected the SOA TTL capped to 10, got %v", response.Authority)
+		}
+	}
+}
+
+// newClockedCachingResolver caches the answers of an upstream on a fake clock
+func newClockedCachingResolver(t *testing.T, upstream string, options CacheOptions) (*CachingResolver, *fakeClock) {
+	resolver, err := NewForwardingResolver([]string{upstream}, ForwardingOptions{
+		AttemptTimeout: 50 * time.Millisecond,
+		Retries:        -1,
+	})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+	caching := NewCachingResolver(resolver, options)
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	caching.cache.now = clock.Now
+	caching.negative.now = clock.Now
+	return caching, clock
+}
+
+func resolveA(t *testing.T, resolver Resolver, name string) *msg.Message {
+	t.Helper()
+	response, err := resolver.Resolve(context.Background(), newQuery(
+		&msg.Question{Name: name, Type: msg.TypeA, Class: msg.ClassINET},
+	))
+	if err != nil {
+		t.Fatal("Failed to resolve:", err)
+	}
+	return response
+}
+
+func TestCachingResolverPrefetches(t *testing.T) {
+	var received int32
+	answer := answerA(net.IPv4(10, 0, 0, 1))
+	upstream := startUpstream(t, func(request *msg.Message) *msg.Message {
+		atomic.AddInt32(&received, 1)
+		return answer(request)
+	})
+	caching, clock := newClockedCachingResolver(t, upstream, CacheOptions{PrefetchFraction: 0.5})
+
+	resolveA(t, caching, "abc.test")
+	clock.Advance(20 * time.Second)
+	resolveA(t, caching, "abc.test")
+	if queries := atomic.LoadInt32(&received); queries != 1 {
+		t.Errorf("Expected no prefetch before half the TTL, got %d upstream queries", queries)
+	}
+
+	// Past half of the 60s TTL, the hit is answered from cache and refreshed in the background
+	clock.Advance(20 * time.Second)
+	if response := resolveA(t, caching, "abc.test"); response.Answers[0].TTL != 20 {
+		t.Errorf("Expected the cached answer with TTL 20, got %d", response.Answers[0].TTL)
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&received) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Wait for the refreshed entry to be stored
+	for time.Now().Before(deadline) {
+		if response, _, _ := caching.cache.get(newCacheKey(&msg.Question{Name: "abc.test", Type: msg.TypeA, Class: msg.ClassINET})); response.Answers[0].TTL == 60 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The old entry would have expired by now
+	clock.Advance(30 * time.Second)
+	resolveA(t, caching, "abc.test")
+	if queries := atomic.LoadInt32(&received); queries != 2 {
+		t.Errorf("Expected a single prefetch, got %d upstream queries", queries)
+	}
+	if stats := caching.Stats(); stats.Prefetches != 1 || stats.Misses != 1 {
+		t.Errorf("Expected 1 prefetch and 1 miss, got %+v", stats)
+	}
+}
+
+func TestCachingResolverServesStale(t *testing.T) {
+	var down int32
+	answer := answerA(net.IPv4(10, 0, 0, 1))
+	upstream := startUpstream(t, func(request *msg.Message) *msg.Message {
+		if atomic.LoadInt32(&down) == 1 {
+			return nil
+		}
+		return answer(request)
+	})
+	caching, clock := newClockedCachingResolver(t, upstream, CacheOptions{MaxStale: time.Hour})
+
+	resolveA(t, caching, "abc.test")
+	atomic.StoreInt32(&down, 1)
+	clock.Advance(2 * time.Minute)
+
+	response := resolveA(t, caching, "abc.test")
+	if response.Header.ResponseCode != msg.Succeeded || len(response.Answers) != 1 || response.Answers[0].TTL != staleAnswerTTL {
+		t.Errorf("Expected the stale answer with TTL %d, got RCODE %d with %v", staleAnswerTTL, response.Header.ResponseCode, response.Answers)
+	}
+
+	clock.Advance(time.Hour)
+	if response := resolveA(t, caching, "abc.test"); response.Header.ResponseCode != msg.ServerFailure {
+		t.Errorf("Expected SERVFAIL past the stale limit, got RCODE %d", response.Header.ResponseCode)
+	}
+	if stats := caching.Stats(); stats.Stale != 1 {
+		t.Errorf("Expected 1 stale answer, got %+v", stats)
+	}
+}
+
+func TestCachingResolverServesStaleWhenSlow(t *testing.T) {
+	var slow int32
+	upstream := startUpstream(t, func(request *msg.Message) *msg.Message {
+		if atomic.LoadInt32(&slow) == 0 {
+			return answerA(net.IPv4(10, 0, 0, 1))(request)
+		}
+		time.Sleep(300 * time.Millisecond)
+		return answerA(net.IPv4(10, 0, 0, 2))(request)
+	})
+	resolver, err := NewForwardingResolver([]string{upstream}, ForwardingOptions{
+		AttemptTimeout: time.Second,
+		Retries:        -1,
+	})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+	caching := NewCachingResolver(resolver, CacheOptions{MaxStale: time.Hour, StaleAnswerTimeout: 50 * time.Millisecond})
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	caching.cache.now = clock.Now
+	caching.negative.now = clock.Now
+
+	resolveA(t, caching, "abc.test")
+	atomic.StoreInt32(&slow, 1)
+	clock.Advance(2 * time.Minute)
+
+	start := time.Now()
+	response := resolveA(t, caching, "abc.test")
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("Expected the stale answer before the refresh, got it after %s", elapsed)
+	}
+	if len(response.Answers) != 1 || response.Answers[0].TTL != staleAnswerTTL {
+		t.Errorf("Expected the stale answer with TTL %d, got %v", staleAnswerTTL, response.Answers)
+	}
+
+	// The refresh goes on in the background
+	key := newCacheKey(&msg.Question{Name: "abc.test", Type: msg.TypeA, Class: msg.ClassINET})
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, _, ok := caching.cache.get(key); ok {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	response = resolveA(t, caching, "abc.test")
+	if len(response.Answers) != 1 || !response.Answers[0].Data.(*msg.A).IP.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("Expected the refreshed answer, got %v", response.Answers)
+	}
+	if stats := caching.Stats(); stats.Stale != 1 || stats.Hits != 1 {
+		t.Errorf("Expected 1 stale answer and 1 hit, got %+v", stats)
+	}
+}
@@ -1,150 +1,273 @@
 package resolver
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
 	msg "github.com/rodweb/dns/internal/message"
-	"math/rand"
-	"net"
-	"strconv"
-	"strings"
+	"log"
 	"sync"
+	"time"
 )
 
-// ForwardingResolver is a resolver that forwards requests to another resolver
-type ForwardingResolver struct {
-	IP   net.IP
-	Port int
+// Defaults for the zero values of ForwardingOptions
+const (
+	DefaultAttemptTimeout = 2 * time.Second
+	DefaultRetries        = 1
+	DefaultRetryBackoff   = 100 * time.Millisecond
+	DefaultQueryTimeout   = 5 * time.Second
+)
+
+// ForwardingOptions tunes how queries are sent to the upstreams
+type ForwardingOptions struct {
+	// Strategy decides which upstream is tried first, the others are used for failover
+	Strategy Strategy
+	// AttemptTimeout is how long a single upstream may take to answer before the next one is tried
+	AttemptTimeout time.Duration
+	// Retries is the number of extra rounds over all upstreams once every one of them failed
+	Retries int
+	// RetryBackoff is the wait before the first retry round, it doubles for every following round
+	RetryBackoff time.Duration
+	// QueryTimeout is the time budget of a whole query, across all attempts and retries
+	QueryTimeout time.Duration
+	// MixedCase randomizes the case of the queried names (0x20 encoding), responses have to echo it.
+	// Upstreams that do not preserve the case of questions will look like they never answer.
+	MixedCase bool
 }
 
-// NewForwardingResolver creates a new forwarding resolver
-func NewForwardingResolver(resolverAddress string) (*ForwardingResolver, error) {
-	parts := strings.Split(resolverAddress, ":")
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("invalid resolver address")
+func (o ForwardingOptions) withDefaults() ForwardingOptions {
+	if o.AttemptTimeout <= 0 {
+		o.AttemptTimeout = DefaultAttemptTimeout
+	}
+	if o.Retries < 0 {
+		o.Retries = 0
+	} else if o.Retries == 0 {
+		o.Retries = DefaultRetries
+	}
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = DefaultRetryBackoff
 	}
-	ip := net.ParseIP(parts[0])
-	if ip == nil {
-		return nil, fmt.Errorf("invalid IP address")
+	if o.QueryTimeout <= 0 {
+		o.QueryTimeout = DefaultQueryTimeout
 	}
-	port, err := strconv.Atoi(parts[1])
+	return o
+}
+
+// ForwardingResolver is a resolver that forwards requests to other resolvers
+type ForwardingResolver struct {
+	upstreams *upstreamPool
+	options   ForwardingOptions
+}
+
+// NewForwardingResolver creates a new forwarding resolver for one or more ip:port addresses.
+// Zero values in options are replaced by their defaults, use a negative Retries to disable retrying.
+func NewForwardingResolver(resolverAddresses []string, options ForwardingOptions) (*ForwardingResolver, error) {
+	upstreams := make([]*Upstream, 0, len(resolverAddresses))
+	for _, address := range resolverAddresses {
+		upstream, err := NewUpstream(address)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", address, err)
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	pool, err := newUpstreamPool(upstreams, options.Strategy)
 	if err != nil {
-		return nil, fmt.Errorf("invalid port")
+		return nil, err
 	}
 	return &ForwardingResolver{
-		IP:   ip,
-		Port: port,
+		upstreams: pool,
+		options:   options.withDefaults(),
 	}, nil
 }
 
-// TODO: Improve error handling
-// Resolve resolves a request by forwarding it to another resolver
-func (r *ForwardingResolver) Resolve(originalMessage *msg.Message) (*msg.Message, error) {
-	// When forwarding a message, we need to split the questions into multiple queries
-
-	// Create a map of ID to question
-	questionMap := make(map[uint16]*msg.Question)
-
-	var wg sync.WaitGroup
-
-	responseChan := make(chan *msg.Message, len(originalMessage.Questions))
+// Upstreams returns the upstream resolvers and their health
+func (r *ForwardingResolver) Upstreams() []*Upstream {
+	return r.upstreams.upstreams
+}
 
-	// For each question, create a new query and forward it to the resolver
-	for _, question := range originalMessage.Questions {
-		id := generateID()
-		questionMap[id] = question
+// Resolve resolves a request by forwarding it to another resolver.
+// Every question is forwarded on its own and the responses are merged back in the order of the questions.
+func (r *ForwardingResolver) Resolve(ctx context.Context, originalMessage *msg.Message) (*msg.Message, error) {
+	return resolveQuestions(ctx, originalMessage, func(ctx context.Context, question *msg.Question) (*msg.Message, error) {
+		// The ID is chosen by the upstream transport for every attempt
 		query := &msg.Message{
 			Header: &msg.Header{
-				ID:            id,
 				OperationCode: originalMessage.Header.OperationCode,
-				QuestionCount: 1,
+				// The upstream has to do the recursion for us
+				RecursionDesired: true,
+				QuestionCount:    1,
 			},
 			Questions: []*msg.Question{
 				question,
 			},
 		}
-		wg.Add(1)
+		// Advertise our buffer size so the upstream does not truncate at 512 bytes
+		edns := &msg.EDNS{UDPSize: msg.DefaultUDPPayloadSize}
+		if requestEDNS := originalMessage.EDNS(); requestEDNS != nil {
+			edns.DNSSECOK = requestEDNS.DNSSECOK
+		}
+		query.SetEDNS(edns)
+		return r.exchange(ctx, query)
+	})
+}
 
-		go func(name string) {
+// resolveQuestions answers the questions of a request concurrently, each on its own, then merges the responses.
+// A question resolve fails for is answered SERVFAIL.
+func resolveQuestions(ctx context.Context, request *msg.Message, resolve func(ctx context.Context, question *msg.Question) (*msg.Message, error)) (*msg.Message, error) {
+	var wg sync.WaitGroup
+	// responses holds the response to each question, nil when it failed
+	responses := make([]*msg.Message, len(request.Questions))
+	for i, question := range request.Questions {
+		wg.Add(1)
+		go func(i int, question *msg.Question) {
 			defer wg.Done()
-			fmt.Printf("Forwarding query for %s\n", name)
-			response, err := forwardQuery(r.IP, r.Port, query.Bytes())
+			response, err := resolve(ctx, question)
 			if err != nil {
-				fmt.Println("Failed forward query:", err)
+				log.Printf("Failed to resolve %s: %s\n", question.Name, err)
 				return
 			}
-			responseChan <- msg.FromBytes(response)
-		}(question.Name)
+			responses[i] = response
+		}(i, question)
 	}
+	wg.Wait()
 
-	// Wait for all responses to be received
-	go func() {
-		wg.Wait()
-		close(responseChan)
-	}()
-
-	questions := make([]*msg.Question, 0, originalMessage.Header.QuestionCount)
-	answers := make([]*msg.Answer, 0, originalMessage.Header.QuestionCount)
-
-	// For each response, add the question and answer to the original response
-	for response := range responseChan {
-		if response.Header.ResponseCode != 0 {
-			fmt.Println("Response code is not 0")
-			continue
-		}
-		question, ok := questionMap[response.Header.ID]
-		if !ok {
-			fmt.Println("ID not found in map")
-			continue
-		}
-		if len(response.Answers) == 0 {
-			fmt.Println("No answers")
-			continue
-		}
-		questions = append(questions, question)
-		answers = append(answers, response.Answers[0])
+	// Nobody is waiting for the answer anymore
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
+	return mergeResponses(request, responses), nil
+}
 
-	return &msg.Message{
+// mergeResponses builds the response to a request from the responses to each of its questions.
+// A nil response stands for a question nobody answered, which fails the whole response.
+func mergeResponses(request *msg.Message, responses []*msg.Message) *msg.Message {
+	response := &msg.Message{
 		Header: &msg.Header{
-			ID:               originalMessage.Header.ID,
-			IsResponse:       true,
-			RecursionDesired: originalMessage.Header.RecursionDesired,
-			OperationCode:    originalMessage.Header.OperationCode,
-			ResponseCode:     msg.GetResponseCode(originalMessage.Header),
-			QuestionCount:    uint16(len(questions)),
-			AnswerCount:      uint16(len(answers)),
+			ID:                 request.Header.ID,
+			IsResponse:         true,
+			RecursionDesired:   request.Header.RecursionDesired,
+			RecursionAvailable: true,
+			OperationCode:      request.Header.OperationCode,
+			ResponseCode:       msg.GetResponseCode(request.Header),
 		},
-		Questions: questions,
-		Answers:   answers,
-	}, nil
+		// Every question is echoed, even those no upstream answered
+		Questions: request.Questions,
+	}
+	for _, questionResponse := range responses {
+		if questionResponse == nil {
+			response.Header.ResponseCode = worseResponseCode(response.Header.ResponseCode, msg.ServerFailure)
+			continue
+		}
+		response.Header.ResponseCode = worseResponseCode(response.Header.ResponseCode, questionResponse.Header.ResponseCode)
+		// A single incomplete answer makes the whole response incomplete
+		response.Header.Truncated = response.Header.Truncated || questionResponse.Header.Truncated
+		response.Answers = append(response.Answers, questionResponse.Answers...)
+		response.Authority = append(response.Authority, questionResponse.Authority...)
+		// The OPT record is negotiated per hop, the handler adds its own
+		questionResponse.SetEDNS(nil)
+		response.Additional = append(response.Additional, questionResponse.Additional...)
+	}
+	return response
 }
 
-// generateID generates a random number between 0 and 65535
-func generateID() uint16 {
-	return uint16(rand.Intn(65535))
+// responseCodeSeverity ranks response codes, so that merging the responses to several questions
+// reports the worst outcome. A failure to answer is worse than an answer saying the name does not exist.
+var responseCodeSeverity = map[msg.ResponseCode]int{
+	msg.Succeeded:      0,
+	msg.NameError:      1,
+	msg.Refused:        2,
+	msg.NotImplemented: 3,
+	msg.FormatError:    4,
+	msg.ServerFailure:  5,
 }
 
-// TODO: Reuse UDP connections
-// forwardQuery forwards a query to another resolver
-func forwardQuery(ip net.IP, port int, data []byte) ([]byte, error) {
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", ip.String(), port))
-	if err != nil {
-		return nil, err
+// worseResponseCode returns the most severe of two response codes, unknown codes rank below SERVFAIL
+func worseResponseCode(a, b msg.ResponseCode) msg.ResponseCode {
+	severity := func(code msg.ResponseCode) int {
+		if rank, ok := responseCodeSeverity[code]; ok {
+			return rank
+		}
+		return responseCodeSeverity[msg.ServerFailure] - 1
+	}
+	if severity(b) > severity(a) {
+		return b
 	}
+	return a
+}
 
-	conn, err := net.DialUDP("udp", nil, addr)
-	if err != nil {
-		return nil, err
+// exchange sends a query to the upstreams in turn until one of them answers.
+// When every upstream failed, it retries after a backoff until the query budget runs out.
+func (r *ForwardingResolver) exchange(ctx context.Context, query *msg.Message) (*msg.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.options.QueryTimeout)
+	defer cancel()
+
+	var lastErr error
+	backoff := r.options.RetryBackoff
+	for round := 0; round <= r.options.Retries; round++ {
+		if round > 0 {
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+			case <-ctx.Done():
+				return nil, fmt.Errorf("query budget exhausted: %s", lastErr)
+			}
+		}
+		for _, upstream := range r.upstreams.candidates() {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("query budget exhausted: %s", lastErr)
+			}
+			response, err := r.attempt(ctx, upstream, query)
+			if err == nil {
+				return response, nil
+			}
+			lastErr = fmt.Errorf("%s: %s", upstream.Address, err)
+		}
 	}
-	defer conn.Close()
+	return nil, lastErr
+}
 
-	_, err = conn.Write(data)
+// attempt sends a query to a single upstream, waiting at most AttemptTimeout for its answer
+func (r *ForwardingResolver) attempt(ctx context.Context, upstream *Upstream, query *msg.Message) (*msg.Message, error) {
+	attemptCtx, cancel := context.WithTimeout(ctx, r.options.AttemptTimeout)
+	defer cancel()
 
-	buffer := make([]byte, 512)
-	size, _, err := conn.ReadFromUDP(buffer)
-	if err != nil {
-		return nil, err
+	outgoing := query
+	if r.options.MixedCase {
+		outgoing = withMixedCase(query)
+	}
+
+	start := time.Now()
+	response, err := upstream.transport.exchange(attemptCtx, outgoing)
+	if err == nil {
+		upstream.success(time.Since(start))
+		// The answer did not fit in UDP, ask for all of it over TCP
+		if response.Header.Truncated {
+			full, err := exchangeTCP(attemptCtx, upstream.Address, outgoing)
+			if err != nil {
+				log.Printf("Failed to retry truncated answer over TCP with %s: %s\n", upstream.Address, err)
+			} else {
+				response = full
+			}
+		}
+		if r.options.MixedCase {
+			restoreCase(response, query.Questions[0].Name)
+		}
+		return response, nil
 	}
+	// Cancellation by the client or the query budget says nothing about the upstream health
+	if ctx.Err() == nil {
+		upstream.failure()
+	}
+	return nil, err
+}
 
-	return buffer[:size], nil
+// generateID generates a random number between 0 and 65535.
+// IDs come from crypto/rand, so an attacker cannot predict them to forge responses.
+func generateID() uint16 {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(fmt.Sprintf("failed to generate query ID: %s", err))
+	}
+	return binary.BigEndian.Uint16(id[:])
 }
@@ -0,0 +1,280 @@
+package resolver
+
+import (
+	"context"
+	msg "github.com/rodweb/dns/internal/message"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForwardingResolverRetries(t *testing.T) {
+	// The upstream loses the first query, as if the packet was dropped
+	var received int32
+	answer := answerA(net.IPv4(10, 0, 0, 1))
+	flaky := startUpstream(t, func(request *msg.Message) *msg.Message {
+		if atomic.AddInt32(&received, 1) == 1 {
+			return nil
+		}
+		return answer(request)
+	})
+	resolver, err := NewForwardingResolver([]string{flaky}, ForwardingOptions{
+		AttemptTimeout: 100 * time.Millisecond,
+		Retries:        2,
+		RetryBackoff:   10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+
+	response, err := resolver.Resolve(context.Background(), newQuery(
+		&msg.Question{Name: "abc.test", Type: msg.TypeA, Class: msg.ClassINET},
+	))
+	if err != nil {
+		t.Fatal("Failed to resolve:", err)
+	}
+	if response.Header.ResponseCode != msg.Succeeded || len(response.Answers) != 1 {
+		t.Errorf("Expected the retry to be answered, got RCODE %d with %v", response.Header.ResponseCode, response.Answers)
+	}
+	if attempts := atomic.LoadInt32(&received); attempts != 2 {
+		t.Errorf("Expected 2 attempts, got %d", attempts)
+	}
+}
+
+func TestForwardingResolverQueryBudget(t *testing.T) {
+	silent := startUpstream(t, func(request *msg.Message) *msg.Message { return nil })
+	resolver, err := NewForwardingResolver([]string{silent}, ForwardingOptions{
+		AttemptTimeout: 100 * time.Millisecond,
+		Retries:        10,
+		QueryTimeout:   300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+
+	start := time.Now()
+	response, err := resolver.Resolve(context.Background(), newQuery(
+		&msg.Question{Name: "abc.test", Type: msg.TypeA, Class: msg.ClassINET},
+	))
+	if err != nil {
+		t.Fatal("Failed to resolve:", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the query budget to stop retries, took %s", elapsed)
+	}
+	if response.Header.ResponseCode != msg.ServerFailure {
+		t.Errorf("Expected SERVFAIL, got RCODE %d", response.Header.ResponseCode)
+	}
+}
+
+func TestForwardingResolverMixedCase(t *testing.T) {
+	const name = "mixed-case.example.test"
+	answer := answerA(net.IPv4(10, 0, 0, 1))
+	received := make(chan string, 1)
+	upstream := startUpstream(t, func(request *msg.Message) *msg.Message {
+		received <- request.Questions[0].Name
+		return answer(request)
+	})
+	resolver, err := NewForwardingResolver([]string{upstream}, ForwardingOptions{MixedCase: true})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+
+	response, err := resolver.Resolve(context.Background(), newQuery(
+		&msg.Question{Name: name, Type: msg.TypeA, Class: msg.ClassINET},
+	))
+	if err != nil {
+		t.Fatal("Failed to resolve:", err)
+	}
+	if sent := <-received; sent == name || !strings.EqualFold(sent, name) {
+		t.Errorf("Expected a mixed case %s, got %s", name, sent)
+	}
+	if len(response.Answers) != 1 || response.Answers[0].Name != name || response.Questions[0].Name != name {
+		t.Errorf("Expected the original case in the response, got %v %v", response.Questions, response.Answers)
+	}
+}
+
+func TestForwardingResolverMixedCaseMismatch(t *testing.T) {
+	// The upstream answers for the lower case name, like an off path forgery would
+	answer := answerA(net.IPv4(10, 0, 0, 1))
+	upstream := startUpstream(t, func(request *msg.Message) *msg.Message {
+		request.Questions[0].Name = strings.ToLower(request.Questions[0].Name)
+		return answer(request)
+	})
+	resolver, err := NewForwardingResolver([]string{upstream}, ForwardingOptions{
+		AttemptTimeout: 100 * time.Millisecond,
+		Retries:        -1,
+		MixedCase:      true,
+	})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+
+	response, err := resolver.Resolve(context.Background(), newQuery(
+		&msg.Question{Name: "mixed-case.example.test", Type: msg.TypeA, Class: msg.ClassINET},
+	))
+	if err != nil {
+		t.Fatal("Failed to resolve:", err)
+	}
+	if response.Header.ResponseCode != msg.ServerFailure {
+		t.Errorf("Expected SERVFAIL, got RCODE %d with %v", response.Header.ResponseCode, response.Answers)
+	}
+}
+
+// answerZone answers like a resolver for a tiny zone, dropping queries for silent.test.
+// Negative answers carry an SOA with a TTL of 60 and a minimum of 30.
+func answerZone(request *msg.Message) *msg.Message {
+	response := newResponse(request)
+	response.Header.RecursionAvailable = true
+	response.Questions = request.Questions
+	question := request.Questions[0]
+	record := func(name string, recordType uint16, data msg.RData) *msg.Answer {
+		return &msg.Answer{Name: name, Type: recordType, Class: msg.ClassINET, TTL: 60, Data: data}
+	}
+	soa := record("test", msg.TypeSOA, &msg.SOA{MName: "ns.test", RName: "admin.test", Serial: 1, Minimum: 30})
+
+	switch question.Name {
+	case "multi.test":
+		response.Answers = []*msg.Answer{
+			record(question.Name, msg.TypeA, &msg.A{IP: net.IPv4(10, 0, 0, 1)}),
+			record(question.Name, msg.TypeA, &msg.A{IP: net.IPv4(10, 0, 0, 2)}),
+		}
+	case "alias.test":
+		response.Answers = []*msg.Answer{
+			record(question.Name, msg.TypeCNAME, &msg.CNAME{Target: "multi.test"}),
+			record("multi.test", msg.TypeA, &msg.A{IP: net.IPv4(10, 0, 0, 1)}),
+		}
+		response.Authority = []*msg.Answer{record("test", msg.TypeNS, &msg.NS{Host: "ns.test"})}
+		response.Additional = []*msg.Answer{record("ns.test", msg.TypeA, &msg.A{IP: net.IPv4(10, 0, 0, 53)})}
+	case "dangling.test":
+		// A CNAME to a name that does not exist
+		response.Answers = []*msg.Answer{record(question.Name, msg.TypeCNAME, &msg.CNAME{Target: "gone.test"})}
+		if question.Type != msg.TypeCNAME {
+			response.Header.ResponseCode = msg.NameError
+			response.Authority = []*msg.Answer{soa}
+		}
+	case "nodata.test":
+		response.Authority = []*msg.Answer{soa}
+	case "silent.test":
+		return nil
+	default:
+		response.Header.ResponseCode = msg.NameError
+		response.Authority = []*msg.Answer{soa}
+	}
+	return response
+}
+
+func TestForwardingResolverMergesResponses(t *testing.T) {
+	resolver, err := NewForwardingResolver([]string{startUpstream(t, answerZone)}, ForwardingOptions{
+		AttemptTimeout: 100 * time.Millisecond,
+		Retries:        -1,
+	})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+	question := func(name string) *msg.Question {
+		return &msg.Question{Name: name, Type: msg.TypeA, Class: msg.ClassINET}
+	}
+
+	response, err := resolver.Resolve(context.Background(), newQuery(question("multi.test"), question("alias.test")))
+	if err != nil {
+		t.Fatal("Failed to resolve:", err)
+	}
+	if response.Header.ResponseCode != msg.Succeeded {
+		t.Errorf("Expected NOERROR, got RCODE %d", response.Header.ResponseCode)
+	}
+	if len(response.Answers) != 4 || response.Answers[1].Data.String() != "10.0.0.2" || response.Answers[2].Type != msg.TypeCNAME {
+		t.Errorf("Expected every answer in question order, got %v", response.Answers)
+	}
+	if len(response.Authority) != 1 || len(response.Additional) != 1 {
+		t.Errorf("Expected authority and additional data, got %v %v", response.Authority, response.Additional)
+	}
+
+	response, err = resolver.Resolve(context.Background(), newQuery(question("multi.test"), question("missing.test")))
+	if err != nil {
+		t.Fatal("Failed to resolve:", err)
+	}
+	if response.Header.ResponseCode != msg.NameError || len(response.Questions) != 2 {
+		t.Errorf("Expected NXDOMAIN for both questions, got RCODE %d for %v", response.Header.ResponseCode, response.Questions)
+	}
+	if len(response.Authority) != 1 || response.Authority[0].Type != msg.TypeSOA {
+		t.Errorf("Expected the SOA of the missing name, got %v", response.Authority)
+	}
+
+	response, err = resolver.Resolve(context.Background(), newQuery(question("missing.test"), question("silent.test")))
+	if err != nil {
+		t.Fatal("Failed to resolve:", err)
+	}
+	if response.Header.ResponseCode != msg.ServerFailure || len(response.Questions) != 2 {
+		t.Errorf("Expected SERVFAIL with the unanswered question, got RCODE %d for %v", response.Header.ResponseCode, response.Questions)
+	}
+}
+
+func TestWorseResponseCode(t *testing.T) {
+	tests := []struct {
+		a, b, worse msg.ResponseCode
+	}{
+		{msg.Succeeded, msg.NameError, msg.NameError},
+		{msg.NameError, msg.Succeeded, msg.NameError},
+		{msg.NameError, msg.Refused, msg.Refused},
+		{msg.ServerFailure, msg.FormatError, msg.ServerFailure},
+		{msg.NameError, 9, 9},
+		{9, msg.ServerFailure, msg.ServerFailure},
+	}
+	for _, test := range tests {
+		if worse := worseResponseCode(test.a, test.b); worse != test.worse {
+			t.Errorf("Expected %d to be worse of %d and %d, got %d", test.worse, test.a, test.b, worse)
+		}
+	}
+}
+
+// answerTruncated answers every question with an empty truncated response, as if the answer did not fit
+func answerTruncated(request *msg.Message) *msg.Message {
+	response := newResponse(request)
+	response.Questions = request.Questions
+	response.Header.Truncated = true
+	return response
+}
+
+func TestForwardingResolverTruncated(t *testing.T) {
+	tests := []struct {
+		name      string
+		tcp       bool
+		truncated bool
+		answers   int
+	}{
+		// The full answer is asked again over TCP
+		{"retried over TCP", true, false, 1},
+		// Without TCP, the client is told the answer is incomplete
+		{"UDP only", false, true, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			address := startUpstream(t, answerTruncated)
+			if test.tcp {
+				startTCPUpstream(t, address, answerA(net.IPv4(10, 0, 0, 1)))
+			}
+			resolver, err := NewForwardingResolver([]string{address}, ForwardingOptions{
+				AttemptTimeout: 200 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal("Failed to create resolver:", err)
+			}
+
+			response, err := resolver.Resolve(context.Background(), newQuery(
+				&msg.Question{Name: "large.test", Type: msg.TypeA, Class: msg.ClassINET},
+			))
+			if err != nil {
+				t.Fatal("Failed to resolve:", err)
+			}
+			if response.Header.Truncated != test.truncated {
+				t.Errorf("Expected TC %t, got %t", test.truncated, response.Header.Truncated)
+			}
+			if len(response.Answers) != test.answers {
+				t.Errorf("Expected %d answers, got %v", test.answers, response.Answers)
+			}
+		})
+	}
+}
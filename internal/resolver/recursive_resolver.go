@@ -0,0 +1,323 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	msg "github.com/rodweb/dns/internal/message"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RootHints are the addresses of the root name servers, a.root-servers.net to m.root-servers.net
+var RootHints = []string{
+	"198.41.0.4",
+	"170.247.170.2",
+	"192.33.4.12",
+	"199.7.91.13",
+	"192.203.230.10",
+	"192.5.5.241",
+	"192.112.36.4",
+	"198.97.190.53",
+	"192.36.148.17",
+	"192.58.128.30",
+	"193.0.14.129",
+	"199.7.83.42",
+	"202.12.27.33",
+}
+
+const (
+	// maxReferrals is the number of delegations followed to answer a single name
+	maxReferrals = 16
+	// maxCNAMEs is the length of the longest CNAME chain followed
+	maxCNAMEs = 8
+	// maxNSDepth is how deep the addresses of name servers are resolved to reach other name servers
+	maxNSDepth = 4
+	// nameServerPort is the port name servers answer on
+	nameServerPort = 53
+)
+
+var (
+	errTooManyReferrals = errors.New("too many referrals")
+	errLameDelegation   = errors.New("referral does not get closer to the name")
+	errCNAMELoop        = errors.New("CNAME loop")
+	errCNAMEChain       = errors.New("CNAME chain too long")
+	errNSDepth          = errors.New("name server resolution too deep")
+	errNoNameServers    = errors.New("no reachable name server")
+)
+
+// RecursiveOptions tunes how a RecursiveResolver reaches name servers
+type RecursiveOptions struct {
+	// Roots are the IP addresses recursion starts from, RootHints when empty
+	Roots []string
+	// AttemptTimeout is how long a single name server may take to answer before the next one is tried
+	AttemptTimeout time.Duration
+	// QueryTimeout is the time budget to answer a question, across all the name servers asked
+	QueryTimeout time.Duration
+}
+
+func (o RecursiveOptions) withDefaults() RecursiveOptions {
+	if len(o.Roots) == 0 {
+		o.Roots = RootHints
+	}
+	if o.AttemptTimeout <= 0 {
+		o.AttemptTimeout = DefaultAttemptTimeout
+	}
+	if o.QueryTimeout <= 0 {
+		o.QueryTimeout = DefaultQueryTimeout
+	}
+	return o
+}
+
+// RecursiveResolver answers questions by walking the delegations from the root name servers
+type RecursiveResolver struct {
+	options RecursiveOptions
+	// port is the port name servers are reached on, changed by tests
+	port int
+}
+
+// NewRecursiveResolver creates a resolver starting from options.Roots.
+// Zero values in options are replaced by their defaults.
+func NewRecursiveResolver(options RecursiveOptions) (*RecursiveResolver, error) {
+	options = options.withDefaults()
+	for _, root := range options.Roots {
+		if net.ParseIP(root) == nil {
+			return nil, fmt.Errorf("invalid root server address %q", root)
+		}
+	}
+	return &RecursiveResolver{
+		options: options,
+		port:    nameServerPort,
+	}, nil
+}
+
+// Resolve answers every question of a request on its own, then merges the answers
+func (r *RecursiveResolver) Resolve(ctx context.Context, request *msg.Message) (*msg.Message, error) {
+	return resolveQuestions(ctx, request, func(ctx context.Context, question *msg.Question) (*msg.Message, error) {
+		ctx, cancel := context.WithTimeout(ctx, r.options.QueryTimeout)
+		defer cancel()
+		return r.resolve(ctx, question, 0)
+	})
+}
+
+// resolve answers a question, following CNAMEs to their target.
+// depth counts the name server addresses being resolved to get here.
+func (r *RecursiveResolver) resolve(ctx context.Context, question *msg.Question, depth int) (*msg.Message, error) {
+	response := &msg.Message{
+		Header:    &msg.Header{IsResponse: true, RecursionAvailable: true},
+		Questions: []*msg.Question{question},
+	}
+	name := question.Name
+	seen := map[string]bool{canonicalName(name): true}
+
+	for {
+		result, zone, err := r.lookup(ctx, name, question.Type, question.Class, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		// The CNAMEs can be followed within the answer. Only records along the chain are trusted,
+		// and only for names in the zone of the server that answered.
+		asked := name
+		answered := false
+		for name == asked || isSubdomain(name, zone) {
+			records, target := recordsFor(result.Answers, name, question.Type)
+			response.Answers = append(response.Answers, records...)
+			if target == "" {
+				answered = len(records) > 0
+				break
+			}
+			if seen[canonicalName(target)] {
+				return nil, errCNAMELoop
+			}
+			seen[canonicalName(target)] = true
+			// seen holds the question name and every target
+			if len(seen) > maxCNAMEs+1 {
+				return nil, errCNAMEChain
+			}
+			name = target
+		}
+		// Otherwise the server answered the chain up to a name it is not authoritative for
+		if answered || name == asked {
+			// The final name has records, does not exist or has no data of the type, as the authority tells
+			response.Header.ResponseCode = result.Header.ResponseCode
+			if !answered {
+				response.Authority = result.Authority
+			}
+			return response, nil
+		}
+	}
+}
+
+// recordsFor returns the records of a type at name, or the CNAME at name with its target
+func recordsFor(answers []*msg.Answer, name string, recordType uint16) ([]*msg.Answer, string) {
+	var records []*msg.Answer
+	for _, answer := range answers {
+		if !sameName(answer.Name, name) {
+			continue
+		}
+		if answer.Type == recordType {
+			records = append(records, answer)
+		}
+	}
+	if len(records) > 0 || recordType == msg.TypeCNAME {
+		return records, ""
+	}
+	for _, answer := range answers {
+		if cname, ok := answer.Data.(*msg.CNAME); ok && sameName(answer.Name, name) {
+			return []*msg.Answer{answer}, cname.Target
+		}
+	}
+	return nil, ""
+}
+
+// lookup walks the delegations from the roots down to a server that answers for name.
+// It returns the response of that server and the zone it was delegated.
+func (r *RecursiveResolver) lookup(ctx context.Context, name string, recordType, class uint16, depth int) (*msg.Message, string, error) {
+	servers := r.options.Roots
+	zone := "."
+	for referral := 0; referral < maxReferrals; referral++ {
+		response, err := r.query(ctx, servers, name, recordType, class)
+		if err != nil {
+			return nil, "", err
+		}
+		switch response.Header.ResponseCode {
+		case msg.Succeeded, msg.NameError:
+		default:
+			return nil, "", fmt.Errorf("name server for %s answered RCODE %d", zone, response.Header.ResponseCode)
+		}
+		if len(response.Answers) > 0 || response.Header.ResponseCode == msg.NameError {
+			return response, zone, nil
+		}
+
+		child, hosts := delegation(response, name)
+		if child == "" || response.Header.AuthoritativeAnswer {
+			// No referral, the name has no data of this type
+			return response, zone, nil
+		}
+		// Each referral has to get closer to the name, or it would never end
+		if !isSubdomain(child, zone) || sameName(child, zone) {
+			return nil, "", errLameDelegation
+		}
+		servers, err = r.nameServerAddresses(ctx, response, zone, hosts, depth)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %s", child, err)
+		}
+		zone = child
+	}
+	return nil, "", errTooManyReferrals
+}
+
+// delegation returns the zone a referral delegates name to and the hosts of its name servers
+func delegation(response *msg.Message, name string) (string, []string) {
+	var zone string
+	var hosts []string
+	for _, record := range response.Authority {
+		ns, ok := record.Data.(*msg.NS)
+		if !ok || !isSubdomain(name, record.Name) {
+			continue
+		}
+		if zone == "" {
+			zone = record.Name
+		}
+		if sameName(record.Name, zone) {
+			hosts = append(hosts, ns.Host)
+		}
+	}
+	return zone, hosts
+}
+
+// nameServerAddresses returns the addresses of the name servers of a referral.
+// Glue is only trusted for hosts inside the zone of the server that sent it,
+// other hosts are resolved from the roots.
+func (r *RecursiveResolver) nameServerAddresses(ctx context.Context, referral *msg.Message, zone string, hosts []string, depth int) ([]string, error) {
+	var addresses, unglued []string
+	for _, host := range hosts {
+		glued := false
+		for _, record := range referral.Additional {
+			a, ok := record.Data.(*msg.A)
+			if ok && sameName(record.Name, host) && isSubdomain(host, zone) {
+				addresses = append(addresses, a.IP.String())
+				glued = true
+			}
+		}
+		if !glued {
+			unglued = append(unglued, host)
+		}
+	}
+	if len(addresses) > 0 {
+		return addresses, nil
+	}
+
+	if depth >= maxNSDepth {
+		return nil, errNSDepth
+	}
+	var lastErr error = errNoNameServers
+	for _, host := range unglued {
+		response, err := r.resolve(ctx, &msg.Question{Name: host, Type: msg.TypeA, Class: msg.ClassINET}, depth+1)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, record := range response.Answers {
+			if a, ok := record.Data.(*msg.A); ok {
+				addresses = append(addresses, a.IP.String())
+			}
+		}
+		if len(addresses) > 0 {
+			return addresses, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// query asks the name servers in turn, until one of them answers
+func (r *RecursiveResolver) query(ctx context.Context, servers []string, name string, recordType, class uint16) (*msg.Message, error) {
+	query := &msg.Message{
+		Header: &msg.Header{QuestionCount: 1},
+		Questions: []*msg.Question{
+			{Name: name, Type: recordType, Class: class},
+		},
+	}
+	query.SetEDNS(&msg.EDNS{UDPSize: msg.DefaultUDPPayloadSize})
+
+	var lastErr error = errNoNameServers
+	for _, server := range servers {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, r.options.AttemptTimeout)
+		address := net.JoinHostPort(server, strconv.Itoa(r.port))
+		response, err := exchangeOnce(attemptCtx, address, query)
+		// Referrals and answers too large for UDP are asked again over TCP
+		if err == nil && response.Header.Truncated {
+			response, err = exchangeTCP(attemptCtx, address, query)
+		}
+		cancel()
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %s", server, err)
+			continue
+		}
+		response.SetEDNS(nil)
+		return response, nil
+	}
+	return nil, lastErr
+}
+
+// canonicalName is the lower case form of a name without the trailing dot, the root being empty
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// sameName compares names the way DNS does, ignoring case and the trailing dot
+func sameName(a, b string) bool {
+	return canonicalName(a) == canonicalName(b)
+}
+
+// isSubdomain reports whether child is parent or a name below it
+func isSubdomain(child, parent string) bool {
+	child, parent = canonicalName(child), canonicalName(parent)
+	return parent == "" || child == parent || strings.HasSuffix(child, "."+parent)
+}
@@ -0,0 +1,261 @@
+package resolver
+
+import (
+	"context"
+	msg "github.com/rodweb/dns/internal/message"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func rr(name string, data msg.RData) *msg.Answer {
+	return &msg.Answer{Name: name, Type: data.Type(), Class: msg.ClassINET, TTL: 300, Data: data}
+}
+
+// answerAuthoritative answers like an authoritative server for apex, with a zone made of records.
+// NS records below the apex are delegations, answered with referrals and glue from the records.
+func answerAuthoritative(apex string, records []*msg.Answer) func(request *msg.Message) *msg.Message {
+	soa := rr(apex, &msg.SOA{MName: "ns." + apex, RName: "admin." + apex, Serial: 1, Minimum: 60})
+	return func(request *msg.Message) *msg.Message {
+		response := newResponse(request)
+		response.Questions = request.Questions
+		question := request.Questions[0]
+
+		// Below a zone cut, refer to the child zone
+		for _, record := range records {
+			if record.Type != msg.TypeNS || sameName(record.Name, apex) || !isSubdomain(question.Name, record.Name) {
+				continue
+			}
+			for _, ns := range records {
+				if ns.Type == msg.TypeNS && sameName(ns.Name, record.Name) {
+					response.Authority = append(response.Authority, ns)
+					for _, glue := range records {
+						if glue.Type == msg.TypeA && sameName(glue.Name, ns.Data.(*msg.NS).Host) {
+							response.Additional = append(response.Additional, glue)
+						}
+					}
+				}
+			}
+			return response
+		}
+
+		response.Header.AuthoritativeAnswer = true
+		exists := false
+		for _, record := range records {
+			if !sameName(record.Name, question.Name) {
+				continue
+			}
+			exists = true
+			if record.Type == question.Type {
+				response.Answers = append(response.Answers, record)
+			}
+			// Like real servers, follow the CNAME within the zone data
+			if cname, ok := record.Data.(*msg.CNAME); ok && question.Type != msg.TypeCNAME {
+				response.Answers = append(response.Answers, record)
+				for _, target := range records {
+					if sameName(target.Name, cname.Target) && target.Type == question.Type {
+						response.Answers = append(response.Answers, target)
+					}
+				}
+			}
+		}
+		if len(response.Answers) == 0 {
+			if !exists {
+				response.Header.ResponseCode = msg.NameError
+			}
+			response.Authority = []*msg.Answer{soa}
+		}
+		return response
+	}
+}
+
+// startAuthoritative serves a zone on ip and port, so that it can be found through glue
+func startAuthoritative(t *testing.T, ip string, port int, apex string, records ...*msg.Answer) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip), Port: port})
+	if err != nil {
+		t.Fatal("Failed to bind name server:", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	answer := answerAuthoritative(apex, records)
+
+	go func() {
+		buffer := make([]byte, msg.DefaultUDPPayloadSize)
+		for {
+			size, source, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			request, err := msg.FromBytes(buffer[:size])
+			if err != nil {
+				continue
+			}
+			conn.WriteToUDP(answer(request).Bytes(), source)
+		}
+	}()
+}
+
+// startHierarchy serves a small DNS tree on loopback addresses sharing a port:
+//
+//	127.0.0.2 the root, delegating test and other
+//	127.0.0.3 test, delegating sub.test to ns.other without glue, and lame.test back to the root
+//	127.0.0.4 other, with the address of ns.other
+//	127.0.0.5 sub.test
+//
+// cycle.test and cycle.other are delegated to name servers inside each other.
+func startHierarchy(t *testing.T) *RecursiveResolver {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Fatal("Failed to find a free port:", err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	startAuthoritative(t, "127.0.0.2", port, "",
+		rr("test", &msg.NS{Host: "ns.test"}),
+		rr("ns.test", &msg.A{IP: net.IPv4(127, 0, 0, 3)}),
+		rr("other", &msg.NS{Host: "ns1.other"}),
+		rr("ns1.other", &msg.A{IP: net.IPv4(127, 0, 0, 4)}),
+	)
+	startAuthoritative(t, "127.0.0.3", port, "test",
+		rr("www.test", &msg.A{IP: net.IPv4(10, 0, 0, 1)}),
+		rr("www.test", &msg.A{IP: net.IPv4(10, 0, 0, 11)}),
+		rr("alias.test", &msg.CNAME{Target: "www.test"}),
+		rr("far.test", &msg.CNAME{Target: "www.other"}),
+		rr("loop.test", &msg.CNAME{Target: "loop.other"}),
+		rr("sub.test", &msg.NS{Host: "ns.other"}),
+		rr("cycle.test", &msg.NS{Host: "ns.cycle.other"}),
+		rr("lame.test", &msg.NS{Host: "ns.lame.test"}),
+		rr("ns.lame.test", &msg.A{IP: net.IPv4(127, 0, 0, 2)}),
+	)
+	startAuthoritative(t, "127.0.0.4", port, "other",
+		rr("www.other", &msg.A{IP: net.IPv4(10, 0, 0, 2)}),
+		rr("ns.other", &msg.A{IP: net.IPv4(127, 0, 0, 5)}),
+		rr("loop.other", &msg.CNAME{Target: "loop.test"}),
+		rr("cycle.other", &msg.NS{Host: "ns.cycle.test"}),
+		// A poisoning attempt, spoofing the address of www.test from another zone
+		rr("poison.other", &msg.CNAME{Target: "www.test"}),
+		rr("www.test", &msg.A{IP: net.IPv4(6, 6, 6, 6)}),
+	)
+	startAuthoritative(t, "127.0.0.5", port, "sub.test",
+		rr("host.sub.test", &msg.A{IP: net.IPv4(10, 0, 0, 3)}),
+	)
+
+	resolver, err := NewRecursiveResolver(RecursiveOptions{
+		Roots:          []string{"127.0.0.2"},
+		AttemptTimeout: 200 * time.Millisecond,
+		QueryTimeout:   2 * time.Second,
+	})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+	resolver.port = port
+	return resolver
+}
+
+func TestRecursiveResolver(t *testing.T) {
+	resolver := startHierarchy(t)
+
+	tests := []struct {
+		name    string
+		code    msg.ResponseCode
+		answers []string
+	}{
+		// Referrals with glue
+		{"www.test", msg.Succeeded, []string{"10.0.0.1", "10.0.0.11"}},
+		// A CNAME answered along with its target
+		{"alias.test", msg.Succeeded, []string{"www.test.", "10.0.0.1", "10.0.0.11"}},
+		// A CNAME to another zone, resolved from the root again
+		{"far.test", msg.Succeeded, []string{"www.other.", "10.0.0.2"}},
+		// The records of www.test from the other zone are ignored
+		{"poison.other", msg.Succeeded, []string{"www.test.", "10.0.0.1", "10.0.0.11"}},
+		// A delegation to a name server outside of the zone, without glue
+		{"host.sub.test", msg.Succeeded, []string{"10.0.0.3"}},
+		{"missing.test", msg.NameError, nil},
+		{"www.test.", msg.Succeeded, []string{"10.0.0.1", "10.0.0.11"}},
+		// Loops end in SERVFAIL
+		{"loop.test", msg.ServerFailure, nil},
+		{"www.cycle.test", msg.ServerFailure, nil},
+		{"www.lame.test", msg.ServerFailure, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := resolver.Resolve(context.Background(), newQuery(
+				&msg.Question{Name: test.name, Type: msg.TypeA, Class: msg.ClassINET},
+			))
+			if err != nil {
+				t.Fatal("Failed to resolve:", err)
+			}
+			if response.Header.ResponseCode != test.code {
+				t.Errorf("Expected RCODE %d, got %d", test.code, response.Header.ResponseCode)
+			}
+			if len(response.Answers) != len(test.answers) {
+				t.Fatalf("Expected answers %v, got %v", test.answers, response.Answers)
+			}
+			for i, answer := range response.Answers {
+				if answer.Data.String() != test.answers[i] {
+					t.Errorf("Expected answers %v, got %v", test.answers, response.Answers)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestRecursiveResolverNoData(t *testing.T) {
+	resolver := startHierarchy(t)
+
+	response, err := resolver.Resolve(context.Background(), newQuery(
+		&msg.Question{Name: "www.test", Type: msg.TypeMX, Class: msg.ClassINET},
+	))
+	if err != nil {
+		t.Fatal("Failed to resolve:", err)
+	}
+	if response.Header.ResponseCode != msg.Succeeded || len(response.Answers) != 0 {
+		t.Errorf("Expected NODATA, got RCODE %d with %v", response.Header.ResponseCode, response.Answers)
+	}
+	if len(response.Authority) != 1 || response.Authority[0].Type != msg.TypeSOA {
+		t.Errorf("Expected the SOA of the zone, got %v", response.Authority)
+	}
+}
+
+func TestRecursiveResolverInvalidRoot(t *testing.T) {
+	if _, err := NewRecursiveResolver(RecursiveOptions{Roots: []string{"a.root-servers.net"}}); err == nil {
+		t.Error("Expected a root that is not an IP address to fail")
+	}
+	resolver, err := NewRecursiveResolver(RecursiveOptions{})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+	if len(resolver.options.Roots) != len(RootHints) || resolver.port != 53 {
+		t.Errorf("Expected the root hints on port 53, got %v port %d", resolver.options.Roots, resolver.port)
+	}
+}
+
+func TestRecursiveResolverTruncated(t *testing.T) {
+	// The root truncates every answer over UDP and serves the full answers over TCP
+	address := startUpstream(t, answerTruncated)
+	startTCPUpstream(t, address, answerAuthoritative("",
+		[]*msg.Answer{rr("www.test", &msg.A{IP: net.IPv4(10, 0, 0, 1)})},
+	))
+	host, port, _ := net.SplitHostPort(address)
+	resolver, err := NewRecursiveResolver(RecursiveOptions{
+		Roots:          []string{host},
+		AttemptTimeout: 200 * time.Millisecond,
+		QueryTimeout:   time.Second,
+	})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+	resolver.port, _ = strconv.Atoi(port)
+
+	response, err := resolver.Resolve(context.Background(), newQuery(
+		&msg.Question{Name: "www.test", Type: msg.TypeA, Class: msg.ClassINET},
+	))
+	if err != nil {
+		t.Fatal("Failed to resolve:", err)
+	}
+	if response.Header.ResponseCode != msg.Succeeded || len(response.Answers) != 1 || response.Header.Truncated {
+		t.Errorf("Expected the answer over TCP, got RCODE %d with %v", response.Header.ResponseCode, response.Answers)
+	}
+}
@@ -1,116 +1,343 @@
 package resolver
 
 import (
+	"context"
 	"fmt"
 	cfg "github.com/rodweb/dns/internal/config"
 	msg "github.com/rodweb/dns/internal/message"
-	"strconv"
+	"github.com/rodweb/dns/internal/zone"
+	"log"
 	"strings"
 )
 
+// Resolver resolves the questions of a DNS request
+type Resolver interface {
+	Resolve(ctx context.Context, request *msg.Message) (*msg.Message, error)
+}
+
+// LocalOptions tunes how a DefaultResolver answers from the local records
+type LocalOptions struct {
+	// Order is the order the records of a name and type are answered in, fixed when empty
+	Order RRsetOrder
+}
+
+// DefaultResolver answers from the locally configured DNS records.
+// Records under an SOA form a zone the resolver is authoritative for: names of the zone without
+// the data asked get an NXDOMAIN or NODATA answer, along with the SOA.
+// Wildcard owners such as *.example.test answer for the names below them that do not exist.
+// Other questions are passed to the next resolver in the chain if any, or refused.
 type DefaultResolver struct {
-	dnsRecords map[string]*cfg.Record
+	options LocalOptions
+	// rrsets holds the records grouped by name and type
+	rrsets map[rrsetKey]*rrset
+	// zones holds the apex of every local zone, the owners of the SOA records
+	zones []string
+	// names holds the owners of the records and every name above them, which exist even without records
+	names map[string]bool
+	next  Resolver
 }
 
-func NewDefaultResolver(dnsRecords map[string]*cfg.Record) *DefaultResolver {
-	return &DefaultResolver{
-		dnsRecords: dnsRecords,
+// NewDefaultResolver creates a resolver for local records, the records of the config file
+// and the records read from zone files, next may be nil.
+// Records of the same name and type are answered together, names are matched case insensitively.
+func NewDefaultResolver(records []*cfg.Record, zoneRecords []*msg.Answer, next Resolver, options LocalOptions) (*DefaultResolver, error) {
+	order, err := options.Order.validate()
+	if err != nil {
+		return nil, err
 	}
-}
+	options.Order = order
 
-func (r *DefaultResolver) Resolve(request *msg.Message) (*msg.Message, error) {
-	response := newResponse(request)
-	for _, question := range request.Questions {
-		recordType := toRecordType(question.Type)
-		// TODO: forward queries with non implemented but valid record types
-		if recordType == "" {
-			return nil, fmt.Errorf("invalid record type %d", question.Type)
+	r := &DefaultResolver{
+		options: options,
+		rrsets:  make(map[rrsetKey]*rrset),
+		names:   make(map[string]bool),
+		next:    next,
+	}
+	for _, record := range records {
+		// Names of zone files are checked when parsing them, those of the config file are not
+		if err := msg.CheckName(record.Name); err != nil {
+			return nil, fmt.Errorf("record %s %s: %s", record.Name, record.Type, err)
 		}
+		data, err := parseRecordData(record.Type, record.Value)
+		if err != nil {
+			return nil, fmt.Errorf("record %s %s: %s", record.Name, record.Type, err)
+		}
+		r.add(record.Name, data, uint32(record.TTL))
+	}
+	for _, record := range zoneRecords {
+		r.add(record.Name, record.Data, record.TTL)
+	}
 
-		// TODO: forward queries when not found locally
-		key := fmt.Sprintf("%s:%s", recordType, question.Name)
-		record, ok := r.dnsRecords[key]
-		if !ok {
-			continue
+	// A CNAME has to be the only record of its name, otherwise the alias would be ambiguous
+	// https://www.rfc-editor.org/rfc/rfc2181#section-10.1
+	types := make(map[string]int)
+	for key := range r.rrsets {
+		types[key.name]++
+	}
+	for key, set := range r.rrsets {
+		if key.rrType == msg.TypeCNAME && (len(set.data) > 1 || types[key.name] > 1) {
+			return nil, fmt.Errorf("CNAME %s is not the only record of its name", set.name)
 		}
+	}
+	return r, nil
+}
 
-		answer, err := newAnswer(question, record)
+// add adds a record to the RRset of its name and type
+func (r *DefaultResolver) add(owner string, data msg.RData, ttl uint32) {
+	key := newRRsetKey(owner, data.Type())
+	set, ok := r.rrsets[key]
+	if !ok {
+		set = &rrset{name: owner}
+		r.rrsets[key] = set
+	}
+	set.add(data, ttl)
+
+	name := key.name
+	if key.rrType == msg.TypeSOA && !ok {
+		r.zones = append(r.zones, name)
+	}
+	// Names between the records and the root are empty non-terminals, they exist without data
+	for {
+		r.names[name] = true
+		dot := strings.IndexByte(name, '.')
+		if dot < 0 {
+			break
+		}
+		name = name[dot+1:]
+	}
+}
+
+// Resolve answers the questions for local names, asking the next resolver the others.
+// The response is authoritative when every question was answered from a local zone.
+func (r *DefaultResolver) Resolve(ctx context.Context, request *msg.Message) (*msg.Message, error) {
+	response := newResponse(request)
+	response.Header.ResponseCode = msg.GetResponseCode(request.Header)
+	response.Header.AuthoritativeAnswer = len(request.Questions) > 0
+	var unanswered []*msg.Question
+	for _, question := range request.Questions {
+		local, err := r.answer(ctx, request, question, response)
 		if err != nil {
-			// TODO: respond with a valid DNS message
 			return nil, err
 		}
+		if !local {
+			unanswered = append(unanswered, question)
+		}
+	}
 
-		response.Questions = append(response.Questions, question)
-		response.Answers = append(response.Answers, answer)
+	if len(unanswered) > 0 {
+		response.Header.AuthoritativeAnswer = false
+		if r.next == nil {
+			// Nobody else can answer names outside of the local zones
+			response.Questions = append(response.Questions, unanswered...)
+			response.Header.ResponseCode = worseResponseCode(response.Header.ResponseCode, msg.Refused)
+		} else {
+			err := r.resolveNext(ctx, request, unanswered, response)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	response.Header.QuestionCount = uint16(len(response.Questions))
 	response.Header.AnswerCount = uint16(len(response.Answers))
-	// TODO: handle unanswered questions
-	response.Header.ResponseCode = msg.GetResponseCode(request.Header)
+	response.Header.AuthorityCount = uint16(len(response.Authority))
 
 	return response, nil
 }
 
-func newResponse(req *msg.Message) *msg.Message {
-	return &msg.Message{
-		Header: &msg.Header{
-			ID:               req.Header.ID,
-			IsResponse:       true,
-			OperationCode:    req.Header.OperationCode,
-			RecursionDesired: req.Header.RecursionDesired,
-		},
-		Questions: make([]*msg.Question, 0, req.Header.QuestionCount),
-		Answers:   make([]*msg.Answer, 0, req.Header.QuestionCount),
+// answer answers a question from the local records, following CNAMEs through the local data
+// and through the next resolver once they leave it. It returns false for questions with no local data.
+func (r *DefaultResolver) answer(ctx context.Context, request *msg.Message, question *msg.Question, response *msg.Message) (bool, error) {
+	// The local records are all of the Internet class, questions of CHAOS or Hesiod are someone else's
+	if question.Class != msg.ClassINET && question.Class != msg.ClassANY {
+		return false, nil
+	}
+	name := question.Name
+	seen := make(map[string]bool)
+	var chain []*msg.Answer
+	for {
+		apex, authoritative := r.zoneOf(name)
+		// Records matched through a wildcard are answered with the name asked
+		owner := r.owner(name)
+		set, ok := r.rrsets[newRRsetKey(owner, question.Type)]
+		cname, aliased := r.rrsets[newRRsetKey(owner, msg.TypeCNAME)]
+		aliased = aliased && !ok
+		if !ok && !aliased && !authoritative {
+			if len(chain) == 0 {
+				return false, nil
+			}
+			// The chain leads out of the local data
+			response.Answers = append(response.Answers, chain...)
+			return true, r.resolveTarget(ctx, request, question, name, response)
+		}
+
+		if len(chain) == 0 {
+			response.Questions = append(response.Questions, question)
+			// Records outside of the local zones are still served, but without authority
+			if !authoritative {
+				response.Header.AuthoritativeAnswer = false
+			}
+		}
+		switch {
+		case ok:
+			response.Answers = append(response.Answers, chain...)
+			response.Answers = append(response.Answers, set.answers(name, r.options.Order)...)
+		case aliased:
+			seen[canonicalName(name)] = true
+			chain = append(chain, cname.answers(name, r.options.Order)...)
+			name = cname.data[0].(*msg.CNAME).Target
+			if seen[canonicalName(name)] || len(seen) > maxCNAMEs {
+				// Only the failure is answered, a partial chain would look like a valid one
+				log.Printf("Failed to resolve %s: CNAME loop or chain too long\n", question.Name)
+				response.Header.ResponseCode = worseResponseCode(response.Header.ResponseCode, msg.ServerFailure)
+				return true, nil
+			}
+			continue
+		default:
+			// The answer is about the last name of the chain
+			// https://www.rfc-editor.org/rfc/rfc6604#section-2
+			response.Answers = append(response.Answers, chain...)
+			r.answerNegatively(owner, apex, response)
+		}
+		return true, nil
 	}
 }
 
-func newAnswer(q *msg.Question, record *cfg.Record) (*msg.Answer, error) {
-	recordType := toRecordType(q.Type)
-	data, err := parseRecordData(recordType, record.Value)
+// resolveTarget asks the next resolver the records of the target of a local CNAME.
+// Without a next resolver, the client is left to follow the CNAME.
+func (r *DefaultResolver) resolveTarget(ctx context.Context, request *msg.Message, question *msg.Question, target string, response *msg.Message) error {
+	if r.next == nil {
+		return nil
+	}
+	header := *request.Header
+	header.QuestionCount = 1
+	nextResponse, err := r.next.Resolve(ctx, &msg.Message{
+		Header:     &header,
+		Questions:  []*msg.Question{{Name: target, Type: question.Type, Class: question.Class}},
+		Additional: request.Additional,
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// TODO: why not copy Type and Class from Question?
-	return &msg.Answer{
-		Name:  q.Name,
-		Type:  1,
-		Class: 1,
-		TTL:   uint32(record.TTL),
-		Data:  data,
-	}, nil
+	// The data of the target comes from elsewhere
+	response.Header.AuthoritativeAnswer = false
+	response.Header.RecursionAvailable = nextResponse.Header.RecursionAvailable
+	response.Header.ResponseCode = worseResponseCode(response.Header.ResponseCode, nextResponse.Header.ResponseCode)
+	response.Header.Truncated = response.Header.Truncated || nextResponse.Header.Truncated
+	response.Answers = append(response.Answers, nextResponse.Answers...)
+	response.Authority = append(response.Authority, nextResponse.Authority...)
+	response.Additional = append(response.Additional, nextResponse.Additional...)
+	return nil
+}
+
+// owner returns the name holding the records of name: name itself when it exists, or else
+// the wildcard of its closest encloser, the nearest existing name above it, when there is one.
+// Names that exist never match a wildcard, even without records of the type asked,
+// nor do names below an existing name without a wildcard of its own.
+// https://www.rfc-editor.org/rfc/rfc4592#section-3.3.1
+func (r *DefaultResolver) owner(name string) string {
+	encloser := canonicalName(name)
+	if r.names[encloser] {
+		return name
+	}
+	for encloser != "" && !r.names[encloser] {
+		dot := strings.IndexByte(encloser, '.')
+		if dot < 0 {
+			encloser = ""
+		} else {
+			encloser = encloser[dot+1:]
+		}
+	}
+	wildcard := "*"
+	if encloser != "" {
+		wildcard += "." + encloser
+	}
+	if r.names[wildcard] {
+		return wildcard
+	}
+	return name
 }
 
-// TODO: move this to the config.Record itself?
-func parseRecordData(recordType string, data string) ([]byte, error) {
-	switch recordType {
-	case "A":
-		return parseARecord(data)
-	default:
-		return nil, fmt.Errorf("failed to parse record data for type %s", recordType)
+// zoneOf returns the apex of the closest local zone a name belongs to
+func (r *DefaultResolver) zoneOf(name string) (string, bool) {
+	apex, found := "", false
+	for _, zone := range r.zones {
+		if isSubdomain(name, zone) && (!found || len(zone) > len(apex)) {
+			apex, found = zone, true
+		}
 	}
+	return apex, found
 }
 
-func parseARecord(data string) ([]byte, error) {
-	ipParts := strings.Split(data, ".")
-	if len(ipParts) != 4 {
-		return nil, fmt.Errorf("invalid IP data")
+// answerNegatively answers for a name of a local zone without the data asked:
+// NXDOMAIN when the name does not exist, NODATA when it has records of other types.
+// The SOA of the zone goes in the authority section, with the TTL the answer may be cached for.
+// https://www.rfc-editor.org/rfc/rfc2308#section-3
+func (r *DefaultResolver) answerNegatively(name string, apex string, response *msg.Message) {
+	if !r.names[canonicalName(name)] {
+		response.Header.ResponseCode = worseResponseCode(response.Header.ResponseCode, msg.NameError)
 	}
-	ip := make([]byte, 4)
-	for i, part := range ipParts {
-		value, err := strconv.Atoi(part)
-		if err != nil {
-			return nil, fmt.Errorf("invalid IP data")
-		}
-		ip[i] = byte(value)
+
+	set := r.rrsets[newRRsetKey(apex, msg.TypeSOA)]
+	soa := set.data[0].(*msg.SOA)
+	ttl := set.ttl
+	if soa.Minimum < ttl {
+		ttl = soa.Minimum
+	}
+	response.Authority = append(response.Authority, &msg.Answer{
+		Name:  set.name,
+		Type:  msg.TypeSOA,
+		Class: msg.ClassINET,
+		TTL:   ttl,
+		Data:  soa,
+	})
+}
+
+// resolveNext asks the next resolver the questions not found locally and merges its response
+func (r *DefaultResolver) resolveNext(ctx context.Context, request *msg.Message, questions []*msg.Question, response *msg.Message) error {
+	header := *request.Header
+	header.QuestionCount = uint16(len(questions))
+	nextRequest := &msg.Message{
+		Header:     &header,
+		Questions:  questions,
+		Additional: request.Additional,
+	}
+
+	nextResponse, err := r.next.Resolve(ctx, nextRequest)
+	if err != nil {
+		return err
+	}
+
+	response.Header.RecursionAvailable = nextResponse.Header.RecursionAvailable
+	response.Header.ResponseCode = worseResponseCode(response.Header.ResponseCode, nextResponse.Header.ResponseCode)
+	response.Header.Truncated = response.Header.Truncated || nextResponse.Header.Truncated
+	response.Questions = append(response.Questions, nextResponse.Questions...)
+	response.Answers = append(response.Answers, nextResponse.Answers...)
+	response.Authority = append(response.Authority, nextResponse.Authority...)
+	response.Additional = append(response.Additional, nextResponse.Additional...)
+	return nil
+}
+
+func newResponse(req *msg.Message) *msg.Message {
+	return &msg.Message{
+		Header: &msg.Header{
+			ID:               req.Header.ID,
+			IsResponse:       true,
+			OperationCode:    req.Header.OperationCode,
+			RecursionDesired: req.Header.RecursionDesired,
+		},
+		Questions: make([]*msg.Question, 0, req.Header.QuestionCount),
+		Answers:   make([]*msg.Answer, 0, req.Header.QuestionCount),
 	}
-	return ip, nil
 }
 
-func toRecordType(questionType uint16) string {
-	if questionType == 1 {
-		return "A"
+// parseRecordData reads the value of a record in presentation format, as in zone files.
+// Names without a trailing dot are absolute, there is no origin to complete them with.
+func parseRecordData(recordType string, data string) (msg.RData, error) {
+	rrType, ok := msg.StringToType(recordType)
+	if !ok {
+		return nil, fmt.Errorf("unknown record type %s", recordType)
 	}
-	return ""
+	return zone.ParseRData(rrType, data, "")
 }
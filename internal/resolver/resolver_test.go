@@ -0,0 +1,437 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	cfg "github.com/rodweb/dns/internal/config"
+	msg "github.com/rodweb/dns/internal/message"
+	"github.com/rodweb/dns/internal/zone"
+	"net"
+	"strings"
+	"testing"
+)
+
+// staticResolver answers every question with the same A record
+type staticResolver struct {
+	ip        net.IP
+	questions []*msg.Question
+}
+
+func (r *staticResolver) Resolve(ctx context.Context, request *msg.Message) (*msg.Message, error) {
+	r.questions = append(r.questions, request.Questions...)
+	response := newResponse(request)
+	response.Header.RecursionAvailable = true
+	for _, question := range request.Questions {
+		response.Questions = append(response.Questions, question)
+		response.Answers = append(response.Answers, &msg.Answer{
+			Name:  question.Name,
+			Type:  question.Type,
+			Class: question.Class,
+			TTL:   60,
+			Data:  &msg.A{IP: r.ip},
+		})
+	}
+	return response, nil
+}
+
+func newQuery(questions ...*msg.Question) *msg.Message {
+	return &msg.Message{
+		Header: &msg.Header{
+			ID:               1,
+			RecursionDesired: true,
+			QuestionCount:    uint16(len(questions)),
+		},
+		Questions: questions,
+	}
+}
+
+func newDefaultResolver(t *testing.T, records []*cfg.Record, next Resolver) *DefaultResolver {
+	resolver, err := NewDefaultResolver(records, nil, next, LocalOptions{})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+	return resolver
+}
+
+func TestDefaultResolverForwardsUnanswered(t *testing.T) {
+	records := []*cfg.Record{
+		{Name: "local.test", Type: "A", Value: "10.0.0.1", TTL: 60},
+	}
+	next := &staticResolver{ip: net.IPv4(10, 0, 0, 2)}
+	resolver := newDefaultResolver(t, records, next)
+
+	response, err := resolver.Resolve(context.Background(), newQuery(
+		&msg.Question{Name: "local.test", Type: msg.TypeA, Class: msg.ClassINET},
+		&msg.Question{Name: "remote.test", Type: msg.TypeA, Class: msg.ClassINET},
+		&msg.Question{Name: "local.test", Type: msg.TypeMX, Class: msg.ClassINET},
+	))
+	if err != nil {
+		t.Fatal("Failed to resolve:", err)
+	}
+
+	if len(next.questions) != 2 || next.questions[0].Name != "remote.test" || next.questions[1].Type != msg.TypeMX {
+		t.Errorf("Expected only unanswered questions to be forwarded, got %v", next.questions)
+	}
+	if len(response.Answers) != 3 {
+		t.Fatalf("Expected 3 answers, got %d", len(response.Answers))
+	}
+	if response.Answers[0].Data.String() != "10.0.0.1" || response.Answers[1].Data.String() != "10.0.0.2" {
+		t.Errorf("Expected local answer first, got %v", response.Answers)
+	}
+	if !response.Header.RecursionAvailable {
+		t.Error("Expected RA to be set when forwarding")
+	}
+}
+
+func TestDefaultResolverWithoutNext(t *testing.T) {
+	resolver := newDefaultResolver(t, nil, nil)
+
+	response, err := resolver.Resolve(context.Background(), newQuery(
+		&msg.Question{Name: "remote.test", Type: msg.TypeA, Class: msg.ClassINET},
+	))
+	if err != nil {
+		t.Fatal("Failed to resolve:", err)
+	}
+	if len(response.Answers) != 0 || response.Header.RecursionAvailable {
+		t.Errorf("Expected an empty local answer, got %v", response.Answers)
+	}
+}
+
+func TestDefaultResolverClasses(t *testing.T) {
+	const classCHAOS uint16 = 3
+	records := []*cfg.Record{{Name: "local.test", Type: "A", Value: "10.0.0.1", TTL: 60}}
+	tests := []struct {
+		class     uint16
+		next      bool
+		rcode     msg.ResponseCode
+		answer    string
+		forwarded bool
+	}{
+		{msg.ClassINET, false, msg.Succeeded, "10.0.0.1", false},
+		{msg.ClassANY, false, msg.Succeeded, "10.0.0.1", false},
+		{classCHAOS, false, msg.Refused, "", false},
+		{classCHAOS, true, msg.Succeeded, "10.0.0.2", true},
+	}
+	for _, test := range tests {
+		next := &staticResolver{ip: net.IPv4(10, 0, 0, 2)}
+		resolver := newDefaultResolver(t, records, nil)
+		if test.next {
+			resolver = newDefaultResolver(t, records, next)
+		}
+		response, err := resolver.Resolve(context.Background(), newQuery(
+			&msg.Question{Name: "local.test", Type: msg.TypeA, Class: test.class},
+		))
+		if err != nil {
+			t.Fatal("Failed to resolve:", err)
+		}
+		if response.Header.ResponseCode != test.rcode {
+			t.Errorf("Expected RCODE %d for class %d, got %d", test.rcode, test.class, response.Header.ResponseCode)
+		}
+		answer := ""
+		if len(response.Answers) > 0 {
+			answer = response.Answers[0].Data.String()
+		}
+		if answer != test.answer {
+			t.Errorf("Expected answer %q for class %d, got %v", test.answer, test.class, response.Answers)
+		}
+		if forwarded := len(next.questions) > 0; forwarded != test.forwarded {
+			t.Errorf("Expected forwarded %t for class %d, got %t", test.forwarded, test.class, forwarded)
+		}
+	}
+}
+
+func TestDefaultResolverTypedRecords(t *testing.T) {
+	records := []*cfg.Record{
+		{Name: "local.test", Type: "MX", Value: "10 mail.local.test.", TTL: 60},
+		{Name: "local.test", Type: "TXT", Value: `"v=spf1 -all"`, TTL: 60},
+	}
+	resolver := newDefaultResolver(t, records, nil)
+
+	response, err := resolver.Resolve(context.Background(), newQuery(
+		&msg.Question{Name: "local.test", Type: msg.TypeMX, Class: msg.ClassINET},
+		&msg.Question{Name: "local.test", Type: msg.TypeTXT, Class: msg.ClassINET},
+	))
+	if err != nil {
+		t.Fatal("Failed to resolve:", err)
+	}
+	if len(response.Answers) != 2 {
+		t.Fatalf("Expected 2 answers, got %v", response.Answers)
+	}
+	mx, ok := response.Answers[0].Data.(*msg.MX)
+	if !ok || response.Answers[0].Type != msg.TypeMX || mx.Exchange != "mail.local.test" || mx.Preference != 10 {
+		t.Errorf("Expected MX 10 mail.local.test, got %v", response.Answers[0])
+	}
+	txt, ok := response.Answers[1].Data.(*msg.TXT)
+	if !ok || response.Answers[1].Type != msg.TypeTXT || len(txt.Texts) != 1 || txt.Texts[0] != "v=spf1 -all" {
+		t.Errorf("Expected TXT v=spf1 -all, got %v", response.Answers[1])
+	}
+}
+
+func newZoneRecords() []*cfg.Record {
+	return []*cfg.Record{
+		{Name: "example.test", Type: "SOA", Value: "ns.example.test. admin.example.test. 1 7200 900 1209600 300", TTL: 3600},
+		{Name: "www.example.test", Type: "A", Value: "10.0.0.1", TTL: 60},
+		{Name: "a.b.example.test", Type: "A", Value: "10.0.0.2", TTL: 60},
+		{Name: "local.test", Type: "A", Value: "10.0.0.3", TTL: 60},
+	}
+}
+
+func TestDefaultResolverZones(t *testing.T) {
+	resolver := newDefaultResolver(t, newZoneRecords(), nil)
+
+	tests := []struct {
+		name          string
+		rrType        uint16
+		code          msg.ResponseCode
+		authoritative bool
+		answers       int
+		soa           bool
+	}{
+		{"www.example.test", msg.TypeA, msg.Succeeded, true, 1, false},
+		{"WWW.Example.Test", msg.TypeA, msg.Succeeded, true, 1, false},
+		// NODATA, the name has records of another type
+		{"www.example.test", msg.TypeMX, msg.Succeeded, true, 0, true},
+		{"missing.example.test", msg.TypeA, msg.NameError, true, 0, true},
+		// An empty non-terminal exists, it has names below it
+		{"b.example.test", msg.TypeA, msg.Succeeded, true, 0, true},
+		// Records outside of the zones are served without authority
+		{"local.test", msg.TypeA, msg.Succeeded, false, 1, false},
+		{"remote.test", msg.TypeA, msg.Refused, false, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name+"/"+msg.TypeToString(test.rrType), func(t *testing.T) {
+			response, err := resolver.Resolve(context.Background(), newQuery(
+				&msg.Question{Name: test.name, Type: test.rrType, Class: msg.ClassINET},
+			))
+			if err != nil {
+				t.Fatal("Failed to resolve:", err)
+			}
+			if response.Header.ResponseCode != test.code {
+				t.Errorf("Expected RCODE %d, got %d", test.code, response.Header.ResponseCode)
+			}
+			if response.Header.AuthoritativeAnswer != test.authoritative {
+				t.Errorf("Expected AA %t, got %t", test.authoritative, response.Header.AuthoritativeAnswer)
+			}
+			if len(response.Answers) != test.answers || len(response.Questions) != 1 {
+				t.Errorf("Expected %d answers to the question, got %v", test.answers, response.Answers)
+			}
+			if !test.soa {
+				if len(response.Authority) != 0 {
+					t.Errorf("Expected no authority, got %v", response.Authority)
+				}
+				return
+			}
+			// The SOA TTL is lowered to its MINIMUM, how long the negative answer may be cached
+			if len(response.Authority) != 1 || response.Authority[0].Type != msg.TypeSOA || response.Authority[0].TTL != 300 {
+				t.Errorf("Expected the SOA with TTL 300, got %v", response.Authority)
+			}
+		})
+	}
+}
+
+func TestDefaultResolverZoneRecords(t *testing.T) {
+	zoneRecords, err := zone.Parse(strings.NewReader(`$TTL 60
+@	SOA ns admin 1 7200 900 1209600 300
+www	TXT "quoted \"text\"" two
+data	TYPE65534 \# 3 0a0b0c
+`), "zone.test")
+	if err != nil {
+		t.Fatal("Failed to parse zone:", err)
+	}
+	records := []*cfg.Record{{Name: "local.test", Type: "A", Value: "10.0.0.1", TTL: 60}}
+	resolver, err := NewDefaultResolver(records, zoneRecords, nil, LocalOptions{})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+
+	// The zone records are answered as parsed, along with the records of the config
+	data, _ := resolveLocal(t, resolver, "www.zone.test", msg.TypeTXT)
+	if len(data) != 1 || data[0] != `"quoted \"text\"" "two"` {
+		t.Errorf("Expected the TXT record of the zone, got %v", data)
+	}
+	data, _ = resolveLocal(t, resolver, "data.zone.test", 65534)
+	if len(data) != 1 || data[0] != `\# 3 0a0b0c` {
+		t.Errorf("Expected the generic record of the zone, got %v", data)
+	}
+	data, _ = resolveLocal(t, resolver, "local.test", msg.TypeA)
+	if len(data) != 1 {
+		t.Errorf("Expected the A record of the config, got %v", data)
+	}
+	response, err := resolver.Resolve(context.Background(), newQuery(
+		&msg.Question{Name: "missing.zone.test", Type: msg.TypeA, Class: msg.ClassINET},
+	))
+	if err != nil {
+		t.Fatal("Failed to resolve:", err)
+	}
+	if response.Header.ResponseCode != msg.NameError || !response.Header.AuthoritativeAnswer {
+		t.Errorf("Expected an authoritative NXDOMAIN from the zone, got RCODE %d", response.Header.ResponseCode)
+	}
+}
+
+func TestDefaultResolverForwardsOutOfZone(t *testing.T) {
+	next := &staticResolver{ip: net.IPv4(10, 0, 0, 9)}
+	resolver := newDefaultResolver(t, newZoneRecords(), next)
+
+	response, err := resolver.Resolve(context.Background(), newQuery(
+		&msg.Question{Name: "missing.example.test", Type: msg.TypeA, Class: msg.ClassINET},
+		&msg.Question{Name: "remote.test", Type: msg.TypeA, Class: msg.ClassINET},
+	))
+	if err != nil {
+		t.Fatal("Failed to resolve:", err)
+	}
+	if len(next.questions) != 1 || next.questions[0].Name != "remote.test" {
+		t.Errorf("Expected only the question outside of the zone to be forwarded, got %v", next.questions)
+	}
+	if response.Header.ResponseCode != msg.NameError || response.Header.AuthoritativeAnswer {
+		t.Errorf("Expected a non authoritative NXDOMAIN, got RCODE %d with AA %t",
+			response.Header.ResponseCode, response.Header.AuthoritativeAnswer)
+	}
+	if len(response.Answers) != 1 || response.Answers[0].Data.String() != "10.0.0.9" {
+		t.Errorf("Expected the forwarded answer, got %v", response.Answers)
+	}
+}
+
+func TestDefaultResolverCNAMEs(t *testing.T) {
+	records := append(newZoneRecords(),
+		&cfg.Record{Name: "alias.example.test", Type: "CNAME", Value: "www.example.test.", TTL: 60},
+		&cfg.Record{Name: "alias2.example.test", Type: "CNAME", Value: "alias.example.test.", TTL: 60},
+		&cfg.Record{Name: "dangling.example.test", Type: "CNAME", Value: "missing.example.test.", TTL: 60},
+		&cfg.Record{Name: "out.example.test", Type: "CNAME", Value: "remote.test.", TTL: 60},
+		&cfg.Record{Name: "loop1.example.test", Type: "CNAME", Value: "loop2.example.test.", TTL: 60},
+		&cfg.Record{Name: "loop2.example.test", Type: "CNAME", Value: "loop1.example.test.", TTL: 60},
+	)
+	// A chain one CNAME longer than followed
+	for i := 0; i <= maxCNAMEs; i++ {
+		records = append(records, &cfg.Record{
+			Name: fmt.Sprintf("c%d.example.test", i), Type: "CNAME", Value: fmt.Sprintf("c%d.example.test.", i+1), TTL: 60,
+		})
+	}
+	records = append(records, &cfg.Record{Name: fmt.Sprintf("c%d.example.test", maxCNAMEs+1), Type: "A", Value: "10.0.0.4", TTL: 60})
+
+	tests := []struct {
+		name          string
+		rrType        uint16
+		code          msg.ResponseCode
+		authoritative bool
+		answers       []string
+	}{
+		{"alias.example.test", msg.TypeA, msg.Succeeded, true, []string{"www.example.test.", "10.0.0.1"}},
+		{"alias2.example.test", msg.TypeA, msg.Succeeded, true, []string{"alias.example.test.", "www.example.test.", "10.0.0.1"}},
+		// The CNAME itself is not followed
+		{"alias.example.test", msg.TypeCNAME, msg.Succeeded, true, []string{"www.example.test."}},
+		{"dangling.example.test", msg.TypeA, msg.NameError, true, []string{"missing.example.test."}},
+		// The target is asked to the next resolver
+		{"out.example.test", msg.TypeA, msg.Succeeded, false, []string{"remote.test.", "10.0.0.9"}},
+		{"loop1.example.test", msg.TypeA, msg.ServerFailure, true, nil},
+		{"c0.example.test", msg.TypeA, msg.ServerFailure, true, nil},
+		{"c1.example.test", msg.TypeA, msg.Succeeded, true, []string{
+			"c2.example.test.", "c3.example.test.", "c4.example.test.", "c5.example.test.",
+			"c6.example.test.", "c7.example.test.", "c8.example.test.", "c9.example.test.", "10.0.0.4",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name+"/"+msg.TypeToString(test.rrType), func(t *testing.T) {
+			next := &staticResolver{ip: net.IPv4(10, 0, 0, 9)}
+			resolver := newDefaultResolver(t, records, next)
+			response, err := resolver.Resolve(context.Background(), newQuery(
+				&msg.Question{Name: test.name, Type: test.rrType, Class: msg.ClassINET},
+			))
+			if err != nil {
+				t.Fatal("Failed to resolve:", err)
+			}
+			if response.Header.ResponseCode != test.code {
+				t.Errorf("Expected RCODE %d, got %d", test.code, response.Header.ResponseCode)
+			}
+			if response.Header.AuthoritativeAnswer != test.authoritative {
+				t.Errorf("Expected AA %t, got %t", test.authoritative, response.Header.AuthoritativeAnswer)
+			}
+			if len(response.Answers) != len(test.answers) {
+				t.Fatalf("Expected answers %v, got %v", test.answers, response.Answers)
+			}
+			for i, answer := range response.Answers {
+				if answer.Data.String() != test.answers[i] {
+					t.Errorf("Expected answers %v, got %v", test.answers, response.Answers)
+					break
+				}
+			}
+			// Only targets outside of the local data are forwarded
+			if test.authoritative && len(next.questions) != 0 {
+				t.Errorf("Expected nothing forwarded, got %v", next.questions)
+			}
+		})
+	}
+}
+
+func TestDefaultResolverCNAMEAndOtherData(t *testing.T) {
+	records := []*cfg.Record{
+		{Name: "alias.local.test", Type: "CNAME", Value: "www.local.test.", TTL: 60},
+		{Name: "alias.local.test", Type: "TXT", Value: `"text"`, TTL: 60},
+	}
+	if _, err := NewDefaultResolver(records, nil, nil, LocalOptions{}); err == nil {
+		t.Error("Expected a CNAME along with other data to fail")
+	}
+}
+
+func TestDefaultResolverWildcards(t *testing.T) {
+	// The example zone of RFC 4592, section 2.2.1
+	records := []*cfg.Record{
+		{Name: "example.test", Type: "SOA", Value: "ns.example.test. admin.example.test. 1 7200 900 1209600 300", TTL: 3600},
+		{Name: "*.example.test", Type: "TXT", Value: `"this is a wildcard"`, TTL: 3600},
+		{Name: "*.example.test", Type: "MX", Value: "10 host1.example.test.", TTL: 3600},
+		{Name: "sub.*.example.test", Type: "TXT", Value: `"this is not a wildcard"`, TTL: 3600},
+		{Name: "host1.example.test", Type: "A", Value: "192.0.2.1", TTL: 3600},
+		{Name: "_ssh._tcp.host1.example.test", Type: "SRV", Value: "0 0 22 host1.example.test.", TTL: 3600},
+		{Name: "_ssh._tcp.host2.example.test", Type: "SRV", Value: "0 0 22 host2.example.test.", TTL: 3600},
+		// A wildcard CNAME outside of any zone
+		{Name: "*.preview.local.test", Type: "CNAME", Value: "lb.local.test.", TTL: 60},
+		{Name: "lb.local.test", Type: "A", Value: "10.0.0.5", TTL: 60},
+	}
+	resolver := newDefaultResolver(t, records, nil)
+
+	tests := []struct {
+		name    string
+		rrType  uint16
+		code    msg.ResponseCode
+		answers []string
+	}{
+		{"host3.example.test", msg.TypeMX, msg.Succeeded, []string{"10 host1.example.test."}},
+		{"foo.bar.example.test", msg.TypeTXT, msg.Succeeded, []string{`"this is a wildcard"`}},
+		// The wildcard exists, but without data of the type
+		{"host3.example.test", msg.TypeA, msg.Succeeded, nil},
+		// Names that exist are never matched by a wildcard
+		{"host1.example.test", msg.TypeMX, msg.Succeeded, nil},
+		{"sub.*.example.test", msg.TypeMX, msg.Succeeded, nil},
+		// The closest encloser is _tcp.host1.example.test, without a wildcard
+		{"_telnet._tcp.host1.example.test", msg.TypeSRV, msg.NameError, nil},
+		{"_tcp.host2.example.test", msg.TypeSRV, msg.Succeeded, nil},
+		// The closest encloser is *.example.test, and *.*.example.test does not exist
+		{"ghost.*.example.test", msg.TypeMX, msg.NameError, nil},
+		{"pr-42.preview.local.test", msg.TypeA, msg.Succeeded, []string{"lb.local.test.", "10.0.0.5"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name+"/"+msg.TypeToString(test.rrType), func(t *testing.T) {
+			response, err := resolver.Resolve(context.Background(), newQuery(
+				&msg.Question{Name: test.name, Type: test.rrType, Class: msg.ClassINET},
+			))
+			if err != nil {
+				t.Fatal("Failed to resolve:", err)
+			}
+			if response.Header.ResponseCode != test.code {
+				t.Errorf("Expected RCODE %d, got %d", test.code, response.Header.ResponseCode)
+			}
+			if len(response.Answers) != len(test.answers) {
+				t.Fatalf("Expected answers %v, got %v", test.answers, response.Answers)
+			}
+			for i, answer := range response.Answers {
+				if answer.Data.String() != test.answers[i] {
+					t.Errorf("Expected answers %v, got %v", test.answers, response.Answers)
+					break
+				}
+			}
+			// Synthesized records are named after the name asked
+			if len(response.Answers) > 0 && response.Answers[0].Name != test.name {
+				t.Errorf("Expected the answer owned by %s, got %s", test.name, response.Answers[0].Name)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package resolver
+
+import (
+	"fmt"
+	msg "github.com/rodweb/dns/internal/message"
+	"math/rand"
+	"sync/atomic"
+)
+
+// RRsetOrder decides the order the records of an RRset are answered in
+type RRsetOrder string
+
+const (
+	// OrderFixed answers the records in the configured order
+	OrderFixed RRsetOrder = "fixed"
+	// OrderCyclic starts each answer with the record after the one the previous answer started with
+	OrderCyclic RRsetOrder = "cyclic"
+	// OrderRandom answers the records in a random order
+	OrderRandom RRsetOrder = "random"
+)
+
+func (o RRsetOrder) validate() (RRsetOrder, error) {
+	switch o {
+	case OrderFixed, OrderCyclic, OrderRandom:
+		return o, nil
+	case "":
+		return OrderFixed, nil
+	default:
+		return "", fmt.Errorf("unknown RRset order %q", o)
+	}
+}
+
+// rrsetKey identifies the records of a name and type, names are compared case insensitively
+type rrsetKey struct {
+	name   string
+	rrType uint16
+}
+
+func newRRsetKey(name string, rrType uint16) rrsetKey {
+	return rrsetKey{
+		name:   canonicalName(name),
+		rrType: rrType,
+	}
+}
+
+// rrset holds the records sharing a name and type, which are always answered together
+// https://www.rfc-editor.org/rfc/rfc2181#section-5
+type rrset struct {
+	// name is the owner as configured
+	name string
+	// ttl is the lowest TTL of the records, RFC 2181 deprecates sets with different TTLs
+	ttl  uint32
+	data []msg.RData
+	// next is the cyclic position
+	next uint32
+}
+
+// add adds a record to the set, unless the set holds the same data already
+func (s *rrset) add(data msg.RData, ttl uint32) {
+	for _, existing := range s.data {
+		if existing.String() == data.String() {
+			return
+		}
+	}
+	if len(s.data) == 0 || ttl < s.ttl {
+		s.ttl = ttl
+	}
+	s.data = append(s.data, data)
+}
+
+// answers returns the records of the set named as asked, the case may differ from the owner, in the given order
+func (s *rrset) answers(name string, order RRsetOrder) []*msg.Answer {
+	data := make([]msg.RData, len(s.data))
+	copy(data, s.data)
+	switch order {
+	case OrderCyclic:
+		start := int(atomic.AddUint32(&s.next, 1)-1) % len(data)
+		data = append(data[start:], data[:start]...)
+	case OrderRandom:
+		rand.Shuffle(len(data), func(i, j int) {
+			data[i], data[j] = data[j], data[i]
+		})
+	}
+
+	answers := make([]*msg.Answer, len(data))
+	for i, d := range data {
+		answers[i] = &msg.Answer{
+			Name:  name,
+			Type:  d.Type(),
+			Class: msg.ClassINET,
+			TTL:   s.ttl,
+			Data:  d,
+		}
+	}
+	return answers
+}
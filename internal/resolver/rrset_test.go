@@ -0,0 +1,96 @@
+package resolver
+
+import (
+	"context"
+	cfg "github.com/rodweb/dns/internal/config"
+	msg "github.com/rodweb/dns/internal/message"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func newRRsetRecords() []*cfg.Record {
+	return []*cfg.Record{
+		{Name: "www.local.test", Type: "A", Value: "10.0.0.1", TTL: 60},
+		{Name: "WWW.local.test", Type: "A", Value: "10.0.0.2", TTL: 30},
+		{Name: "www.local.test", Type: "A", Value: "10.0.0.3", TTL: 60},
+		// The same record twice is a single member of the set
+		{Name: "www.local.test", Type: "A", Value: "10.0.0.1", TTL: 60},
+		{Name: "local.test", Type: "MX", Value: "10 mx1.local.test.", TTL: 60},
+		{Name: "local.test", Type: "MX", Value: "20 mx2.local.test.", TTL: 60},
+	}
+}
+
+// resolveLocal answers a question from the local records and returns the data of the answers
+func resolveLocal(t *testing.T, resolver *DefaultResolver, name string, rrType uint16) ([]string, []*msg.Answer) {
+	response, err := resolver.Resolve(context.Background(), newQuery(
+		&msg.Question{Name: name, Type: rrType, Class: msg.ClassINET},
+	))
+	if err != nil {
+		t.Fatal("Failed to resolve:", err)
+	}
+	data := make([]string, len(response.Answers))
+	for i, answer := range response.Answers {
+		data[i] = answer.Data.String()
+	}
+	return data, response.Answers
+}
+
+func TestDefaultResolverRRsets(t *testing.T) {
+	resolver := newDefaultResolver(t, newRRsetRecords(), nil)
+
+	data, answers := resolveLocal(t, resolver, "www.local.test", msg.TypeA)
+	if strings.Join(data, " ") != "10.0.0.1 10.0.0.2 10.0.0.3" {
+		t.Errorf("Expected every A record in order, got %v", data)
+	}
+	// The set shares the lowest TTL of its records
+	for _, answer := range answers {
+		if answer.TTL != 30 || answer.Name != "www.local.test" {
+			t.Errorf("Expected www.local.test with TTL 30, got %s with TTL %d", answer.Name, answer.TTL)
+		}
+	}
+
+	data, _ = resolveLocal(t, resolver, "local.test", msg.TypeMX)
+	if strings.Join(data, " ") != "10 mx1.local.test. 20 mx2.local.test." {
+		t.Errorf("Expected both MX records, got %v", data)
+	}
+}
+
+func TestDefaultResolverRRsetOrder(t *testing.T) {
+	cyclic, err := NewDefaultResolver(newRRsetRecords(), nil, nil, LocalOptions{Order: OrderCyclic})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+	for _, expected := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1"} {
+		data, _ := resolveLocal(t, cyclic, "www.local.test", msg.TypeA)
+		if len(data) != 3 || data[0] != expected {
+			t.Errorf("Expected the answer to start with %s, got %v", expected, data)
+		}
+	}
+
+	random, err := NewDefaultResolver(newRRsetRecords(), nil, nil, LocalOptions{Order: OrderRandom})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+	data, _ := resolveLocal(t, random, "www.local.test", msg.TypeA)
+	sort.Strings(data)
+	if strings.Join(data, " ") != "10.0.0.1 10.0.0.2 10.0.0.3" {
+		t.Errorf("Expected every A record, got %v", data)
+	}
+}
+
+func TestDefaultResolverInvalidRecords(t *testing.T) {
+	if _, err := NewDefaultResolver(nil, nil, nil, LocalOptions{Order: "sorted"}); err == nil {
+		t.Error("Expected an unknown order to fail")
+	}
+	for _, record := range []*cfg.Record{
+		{Name: "local.test", Type: "A", Value: "10.0.0", TTL: 60},
+		{Name: strings.Repeat("a", 64) + ".local.test", Type: "A", Value: "10.0.0.1", TTL: 60},
+		{Name: strings.Repeat("abcdefg.", 32) + "local.test", Type: "A", Value: "10.0.0.1", TTL: 60},
+		{Name: "www..local.test", Type: "A", Value: "10.0.0.1", TTL: 60},
+	} {
+		if _, err := NewDefaultResolver([]*cfg.Record{record}, nil, nil, LocalOptions{}); err == nil {
+			t.Errorf("Expected the invalid record %s %s to fail", record.Name, record.Value)
+		}
+	}
+}
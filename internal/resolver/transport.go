@@ -0,0 +1,362 @@
+package resolver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	msg "github.com/rodweb/dns/internal/message"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	// transportSockets is the number of UDP sockets each upstream transport spreads its queries over
+	transportSockets = 4
+	// maxSocketQueries is the number of queries sent from a socket before it is replaced,
+	// so that the source port keeps changing and cannot be learned by an attacker
+	maxSocketQueries = 100
+)
+
+var (
+	errSocketClosed       = errors.New("upstream socket closed")
+	errMismatchedResponse = errors.New("response does not match the query")
+)
+
+// transport multiplexes queries to one upstream over a pool of long lived UDP sockets.
+// Sockets are dialed on first use, on a port picked at random by the kernel,
+// and replaced when they break or after maxSocketQueries queries.
+type transport struct {
+	address string
+	// next is the round robin position in sockets
+	next uint32
+
+	mutex   sync.Mutex
+	sockets []*socket
+}
+
+func newTransport(address string) *transport {
+	return &transport{
+		address: address,
+		sockets: make([]*socket, transportSockets),
+	}
+}
+
+// exchange sends a query and waits for its response or for ctx to be done.
+// The query ID is chosen by the transport, so that it is unique among the outstanding queries.
+func (t *transport) exchange(ctx context.Context, query *msg.Message) (*msg.Message, error) {
+	s, err := t.socket()
+	if err != nil {
+		return nil, err
+	}
+	defer s.release()
+	return s.exchange(ctx, query)
+}
+
+// close closes every socket of the transport, failing the queries waiting on them
+func (t *transport) close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i, s := range t.sockets {
+		if s != nil {
+			s.conn.Close()
+			t.sockets[i] = nil
+		}
+	}
+}
+
+// exchangeOnce sends a single query over a socket of its own, for servers that are rarely asked twice
+func exchangeOnce(ctx context.Context, address string, query *msg.Message) (*msg.Message, error) {
+	t := newTransport(address)
+	defer t.close()
+	return t.exchange(ctx, query)
+}
+
+// exchangeTCP sends a query over a TCP connection of its own, for answers truncated over UDP.
+// Messages are prefixed with their length on 2 bytes.
+// https://www.rfc-editor.org/rfc/rfc7766#section-8
+func exchangeTCP(ctx context.Context, address string, query *msg.Message) (*msg.Message, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// Closing the connection unblocks reads and writes once ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	header := *query.Header
+	header.ID = generateID()
+	outgoing := *query
+	outgoing.Header = &header
+	packet, err := outgoing.Pack()
+	if err != nil {
+		return nil, err
+	}
+	framed := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(framed, uint16(len(packet)))
+	copy(framed[2:], packet)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	buffer := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, buffer); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	response, err := msg.FromBytes(buffer)
+	if err != nil {
+		return nil, err
+	}
+	if newPendingKey(response) != newPendingKey(&outgoing) {
+		return nil, errMismatchedResponse
+	}
+	return response, nil
+}
+
+// contextError reports the end of ctx rather than the error of the connection it closed
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// socket returns the next socket of the pool, dialing it if needed.
+// The caller has to release the socket once done with it.
+func (t *transport) socket() (*socket, error) {
+	i := int(atomic.AddUint32(&t.next, 1) % uint32(len(t.sockets)))
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if s := t.sockets[i]; s != nil && s.acquire() {
+		return s, nil
+	}
+	conn, err := net.Dial("udp", t.address)
+	if err != nil {
+		return nil, err
+	}
+	s := &socket{
+		conn:    conn.(*net.UDPConn),
+		pending: make(map[pendingKey]chan exchangeResult),
+	}
+	s.acquire()
+	t.sockets[i] = s
+	go s.read()
+	return s, nil
+}
+
+// pendingKey identifies an outstanding query, responses must echo both its ID and question
+type pendingKey struct {
+	id       uint16
+	question msg.Question
+}
+
+func newPendingKey(m *msg.Message) pendingKey {
+	key := pendingKey{id: m.Header.ID}
+	if len(m.Questions) > 0 {
+		key.question = *m.Questions[0]
+		// The trailing dot is not sent, case is kept as it has to match for 0x20 encoding
+		key.question.Name = strings.TrimSuffix(key.question.Name, ".")
+	}
+	return key
+}
+
+// withMixedCase returns a copy of a single question query with the case of the name randomized.
+// The transport only accepts responses echoing that exact case, which adds about one bit of
+// entropy per letter to what a forged response has to guess.
+func withMixedCase(query *msg.Message) *msg.Message {
+	question := *query.Questions[0]
+	name := []byte(question.Name)
+	random := make([]byte, len(name))
+	if _, err := rand.Read(random); err != nil {
+		panic(fmt.Sprintf("failed to randomize query name: %s", err))
+	}
+	for i, c := range name {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			// Bit 0x20 is what tells lower from upper case ASCII letters apart
+			name[i] = c&^0x20 | random[i]&0x20
+		}
+	}
+	question.Name = string(name)
+
+	outgoing := *query
+	outgoing.Questions = []*msg.Question{&question}
+	return &outgoing
+}
+
+// restoreCase puts back the case of the queried name in a response to a mixed case query
+func restoreCase(response *msg.Message, name string) {
+	for _, question := range response.Questions {
+		if strings.EqualFold(question.Name, name) {
+			question.Name = name
+		}
+	}
+	for _, section := range [][]*msg.Answer{response.Answers, response.Authority, response.Additional} {
+		for _, record := range section {
+			if strings.EqualFold(record.Name, name) {
+				record.Name = name
+			}
+		}
+	}
+}
+
+type exchangeResult struct {
+	response *msg.Message
+	err      error
+}
+
+// socket is a UDP socket connected to an upstream, with the queries waiting for a response on it.
+// Being connected, the kernel only delivers datagrams whose source is the upstream address.
+type socket struct {
+	conn *net.UDPConn
+
+	mutex  sync.Mutex
+	closed bool
+	// queries is the number of queries the socket was handed out for
+	queries int
+	// users is the number of queries currently using the socket
+	users   int
+	pending map[pendingKey]chan exchangeResult
+}
+
+// acquire reserves the socket for a query, it fails once the socket is closed or used up
+func (s *socket) acquire() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed || s.queries >= maxSocketQueries {
+		return false
+	}
+	s.queries++
+	s.users++
+	return true
+}
+
+// release ends a query, closing a used up socket after its last query
+func (s *socket) release() {
+	s.mutex.Lock()
+	s.users--
+	retired := s.users == 0 && s.queries >= maxSocketQueries
+	s.mutex.Unlock()
+	if retired {
+		s.conn.Close()
+	}
+}
+
+func (s *socket) exchange(ctx context.Context, query *msg.Message) (*msg.Message, error) {
+	header := *query.Header
+	outgoing := *query
+	outgoing.Header = &header
+	result := make(chan exchangeResult, 1)
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil, errSocketClosed
+	}
+	var key pendingKey
+	for {
+		header.ID = generateID()
+		key = newPendingKey(&outgoing)
+		if _, used := s.pending[key]; !used {
+			break
+		}
+	}
+	s.pending[key] = result
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.pending, key)
+		s.mutex.Unlock()
+	}()
+
+	packet, err := outgoing.Pack()
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.conn.Write(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case r := <-result:
+		return r.response, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// read dispatches responses to the queries waiting for them.
+// Responses that do not match an outstanding query are dropped.
+func (s *socket) read() {
+	buffer := make([]byte, msg.DefaultUDPPayloadSize)
+	for {
+		size, err := s.conn.Read(buffer)
+		if err != nil {
+			// The upstream port is closed, every query sent there failed
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				s.failPending(err)
+				continue
+			}
+			s.close(err)
+			return
+		}
+
+		response, err := msg.FromBytes(buffer[:size])
+		if err != nil {
+			log.Println("Dropping malformed upstream response:", err)
+			continue
+		}
+		key := newPendingKey(response)
+
+		s.mutex.Lock()
+		result, ok := s.pending[key]
+		delete(s.pending, key)
+		s.mutex.Unlock()
+
+		if !ok {
+			log.Printf("Dropping unexpected upstream response from %s with ID %d\n", s.conn.RemoteAddr(), response.Header.ID)
+			continue
+		}
+		result <- exchangeResult{response: response}
+	}
+}
+
+// failPending fails every query waiting on the socket
+func (s *socket) failPending(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, result := range s.pending {
+		result <- exchangeResult{err: err}
+		delete(s.pending, key)
+	}
+}
+
+// close fails the waiting queries and marks the socket for replacement
+func (s *socket) close(err error) {
+	s.failPending(fmt.Errorf("%s: %s", errSocketClosed, err))
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+	s.conn.Close()
+}
@@ -0,0 +1,186 @@
+package resolver
+
+import (
+	"context"
+	msg "github.com/rodweb/dns/internal/message"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestQuery(name string) *msg.Message {
+	return newQuery(&msg.Question{Name: name, Type: msg.TypeA, Class: msg.ClassINET})
+}
+
+func TestTransportMultiplexesQueries(t *testing.T) {
+	const queries = 3 * transportSockets
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("Failed to bind upstream:", err)
+	}
+	defer conn.Close()
+
+	// The upstream waits for every query, then answers them in reverse order
+	ports := make(map[int]bool)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		type pending struct {
+			request *msg.Message
+			source  *net.UDPAddr
+		}
+		var received []pending
+		buffer := make([]byte, msg.DefaultUDPPayloadSize)
+		for len(received) < queries {
+			size, source, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			request, err := msg.FromBytes(buffer[:size])
+			if err != nil {
+				continue
+			}
+			ports[source.Port] = true
+			received = append(received, pending{request, source})
+		}
+		answer := answerA(net.IPv4(10, 0, 0, 1))
+		for i := len(received) - 1; i >= 0; i-- {
+			conn.WriteToUDP(answer(received[i].request).Bytes(), received[i].source)
+		}
+	}()
+
+	transport := newTransport(conn.LocalAddr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	names := []string{"a.test", "b.test", "c.test", "d.test"}
+	var wg sync.WaitGroup
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			response, err := transport.exchange(ctx, newTestQuery(name))
+			if err != nil {
+				t.Error("Failed to exchange:", err)
+				return
+			}
+			if response.Questions[0].Name != name || len(response.Answers) != 1 {
+				t.Errorf("Expected the answer for %s, got %v", name, response.Questions)
+			}
+		}(names[i%len(names)])
+	}
+	wg.Wait()
+	<-done
+
+	if len(ports) > transportSockets {
+		t.Errorf("Expected at most %d sockets, queries came from %d ports", transportSockets, len(ports))
+	}
+}
+
+func TestTransportDropsMismatchedResponses(t *testing.T) {
+	answer := answerA(net.IPv4(10, 0, 0, 1))
+	tests := []struct {
+		name  string
+		spoof func(response *msg.Message)
+	}{
+		{"wrong ID", func(response *msg.Message) { response.Header.ID++ }},
+		{"wrong name", func(response *msg.Message) { response.Questions[0].Name = "evil.test" }},
+		{"wrong type", func(response *msg.Message) { response.Questions[0].Type = msg.TypeAAAA }},
+		{"no question", func(response *msg.Message) { response.Questions = nil }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			address := startUpstream(t, func(request *msg.Message) *msg.Message {
+				response := answer(request)
+				test.spoof(response)
+				return response
+			})
+			transport := newTransport(address)
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			response, err := transport.exchange(ctx, newTestQuery("abc.test"))
+			if err != context.DeadlineExceeded {
+				t.Errorf("Expected the response to be dropped, got %v (%v)", response, err)
+			}
+		})
+	}
+}
+
+func TestTransportClosedPort(t *testing.T) {
+	transport := newTransport(closedAddress(t))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// The ICMP port unreachable fails the query without waiting for the timeout
+	if _, err := transport.exchange(ctx, newTestQuery("abc.test")); err == nil || err == context.DeadlineExceeded {
+		t.Errorf("Expected a connection error, got %v", err)
+	}
+}
+
+func TestTransportDropsOffPathResponses(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("Failed to bind upstream:", err)
+	}
+	defer conn.Close()
+	attacker, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("Failed to bind attacker:", err)
+	}
+	defer attacker.Close()
+
+	// The attacker sees the query, but has to send its forgery from another address
+	go func() {
+		buffer := make([]byte, msg.DefaultUDPPayloadSize)
+		size, source, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		request, err := msg.FromBytes(buffer[:size])
+		if err != nil {
+			return
+		}
+		forged := answerA(net.IPv4(6, 6, 6, 6))(request)
+		attacker.WriteToUDP(forged.Bytes(), source)
+	}()
+
+	transport := newTransport(conn.LocalAddr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	response, err := transport.exchange(ctx, newTestQuery("abc.test"))
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected the forged response to be dropped, got %v (%v)", response, err)
+	}
+}
+
+func TestTransportReplacesUsedUpSockets(t *testing.T) {
+	transport := newTransport(startUpstream(t, answerA(net.IPv4(10, 0, 0, 1))))
+	ctx := context.Background()
+
+	var first []*socket
+	for i := 0; i < transportSockets*maxSocketQueries+1; i++ {
+		if _, err := transport.exchange(ctx, newTestQuery("abc.test")); err != nil {
+			t.Fatal("Failed to exchange:", err)
+		}
+		if i == transportSockets-1 {
+			first = append(first, transport.sockets...)
+		}
+	}
+
+	// Only the last query went over a used up socket
+	replaced := 0
+	for i, socket := range transport.sockets {
+		if socket != first[i] {
+			replaced++
+			if socket.conn.LocalAddr().String() == first[i].conn.LocalAddr().String() {
+				t.Error("Expected the replacement socket to use another port")
+			}
+		}
+	}
+	if replaced != 1 {
+		t.Errorf("Expected 1 replaced socket, got %d", replaced)
+	}
+}
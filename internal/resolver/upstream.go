@@ -0,0 +1,238 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	msg "github.com/rodweb/dns/internal/message"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy decides in which order upstreams are tried
+type Strategy string
+
+const (
+	// StrategySequential tries upstreams in the configured order
+	StrategySequential Strategy = "sequential"
+	// StrategyRandom tries upstreams in a random order
+	StrategyRandom Strategy = "random"
+	// StrategyRoundRobin starts each query with the upstream after the previous one
+	StrategyRoundRobin Strategy = "round-robin"
+	// StrategyFastest tries upstreams by ascending round trip time
+	StrategyFastest Strategy = "fastest"
+)
+
+const (
+	// maxUpstreamFailures is the number of consecutive failures before an upstream is marked down
+	maxUpstreamFailures = 3
+	// minUpstreamBackoff is how long an upstream stays down the first time
+	minUpstreamBackoff = 5 * time.Second
+	// maxUpstreamBackoff caps the backoff, which doubles every time a probe fails
+	maxUpstreamBackoff = 5 * time.Minute
+	// probeTimeout is how long a probe waits for an upstream to answer
+	probeTimeout = 2 * time.Second
+)
+
+// Upstream is a resolver queries are forwarded to, along with its health
+type Upstream struct {
+	// Address is the ip:port of the upstream resolver
+	Address string
+
+	mutex sync.Mutex
+	// rtt is the smoothed round trip time, zero until the first answer
+	rtt time.Duration
+	// failures is the number of consecutive failed queries
+	failures int
+	// downUntil is when a down upstream is probed again, zero while the upstream is up
+	downUntil time.Time
+	backoff   time.Duration
+	probing   bool
+
+	// transport carries the queries to the upstream over reused sockets
+	transport *transport
+}
+
+// NewUpstream creates an upstream for an ip:port address
+func NewUpstream(address string) (*Upstream, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resolver address")
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address")
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid port")
+	}
+	address = net.JoinHostPort(ip.String(), port)
+	return &Upstream{
+		Address:   address,
+		transport: newTransport(address),
+	}, nil
+}
+
+// RTT returns the smoothed round trip time of the upstream
+func (u *Upstream) RTT() time.Duration {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.rtt
+}
+
+// IsDown reports whether the upstream is out of rotation
+func (u *Upstream) IsDown() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return !u.downUntil.IsZero()
+}
+
+// success records an answer received after rtt
+func (u *Upstream) success(rtt time.Duration) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	// Exponentially weighted moving average, like TCP's SRTT
+	if u.rtt == 0 {
+		u.rtt = rtt
+	} else {
+		u.rtt = (7*u.rtt + rtt) / 8
+	}
+	u.failures = 0
+	// A down upstream answering a query is back up, and goes down with the shortest backoff next time
+	if !u.downUntil.IsZero() {
+		u.downUntil = time.Time{}
+		u.backoff = 0
+		log.Printf("Upstream %s is back up\n", u.Address)
+	}
+}
+
+// failure records a failed query, marking the upstream down when they keep happening
+func (u *Upstream) failure() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.failures++
+	if u.failures >= maxUpstreamFailures && u.downUntil.IsZero() {
+		u.backoff = minUpstreamBackoff
+		u.downUntil = time.Now().Add(u.backoff)
+		log.Printf("Upstream %s is down for %s\n", u.Address, u.backoff)
+	}
+}
+
+// needsProbe reports whether a down upstream finished its backoff and should be probed.
+// Only one caller gets true until the probe completes.
+func (u *Upstream) needsProbe() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.downUntil.IsZero() || u.probing || time.Now().Before(u.downUntil) {
+		return false
+	}
+	u.probing = true
+	return true
+}
+
+// probeResult returns the upstream to rotation, or extends its backoff
+func (u *Upstream) probeResult(ok bool, rtt time.Duration) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.probing = false
+	if ok {
+		u.rtt = rtt
+		u.failures = 0
+		u.downUntil = time.Time{}
+		log.Printf("Upstream %s is back up\n", u.Address)
+		return
+	}
+	// The upstream answered a query while the probe was running
+	if u.downUntil.IsZero() {
+		return
+	}
+	u.backoff *= 2
+	if u.backoff > maxUpstreamBackoff {
+		u.backoff = maxUpstreamBackoff
+	}
+	u.downUntil = time.Now().Add(u.backoff)
+}
+
+// probe checks whether a down upstream answers again by asking for the root name servers
+func (u *Upstream) probe() {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	query := &msg.Message{
+		Header: &msg.Header{
+			RecursionDesired: true,
+		},
+		Questions: []*msg.Question{
+			{Name: "", Type: msg.TypeNS, Class: msg.ClassINET},
+		},
+	}
+	start := time.Now()
+	_, err := u.transport.exchange(ctx, query)
+	u.probeResult(err == nil, time.Since(start))
+}
+
+// upstreamPool orders upstreams for each query according to a strategy
+type upstreamPool struct {
+	upstreams []*Upstream
+	strategy  Strategy
+	// next is the round robin position
+	next uint32
+}
+
+func newUpstreamPool(upstreams []*Upstream, strategy Strategy) (*upstreamPool, error) {
+	switch strategy {
+	case StrategySequential, StrategyRandom, StrategyRoundRobin, StrategyFastest:
+	case "":
+		strategy = StrategySequential
+	default:
+		return nil, fmt.Errorf("unknown upstream strategy %q", strategy)
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream resolver")
+	}
+	return &upstreamPool{
+		upstreams: upstreams,
+		strategy:  strategy,
+	}, nil
+}
+
+// candidates returns the upstreams to try for a query, in order.
+// Upstreams that are down come last, so they are only used when everything else failed.
+// Down upstreams that finished their backoff are probed in the background.
+func (p *upstreamPool) candidates() []*Upstream {
+	ordered := make([]*Upstream, len(p.upstreams))
+	copy(ordered, p.upstreams)
+
+	switch p.strategy {
+	case StrategyRandom:
+		rand.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	case StrategyRoundRobin:
+		start := int(atomic.AddUint32(&p.next, 1)-1) % len(ordered)
+		ordered = append(ordered[start:], ordered[:start]...)
+	case StrategyFastest:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].RTT() < ordered[j].RTT()
+		})
+	}
+
+	up := make([]*Upstream, 0, len(ordered))
+	var down []*Upstream
+	for _, upstream := range ordered {
+		if !upstream.IsDown() {
+			up = append(up, upstream)
+			continue
+		}
+		if upstream.needsProbe() {
+			go upstream.probe()
+		}
+		down = append(down, upstream)
+	}
+	return append(up, down...)
+}
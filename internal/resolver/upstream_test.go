@@ -0,0 +1,248 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	msg "github.com/rodweb/dns/internal/message"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startUpstream serves DNS over UDP on a random local port, answering with answer
+func startUpstream(t *testing.T, answer func(request *msg.Message) *msg.Message) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("Failed to bind upstream:", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, msg.DefaultUDPPayloadSize)
+		for {
+			size, source, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			request, err := msg.FromBytes(buffer[:size])
+			if err != nil {
+				continue
+			}
+			response := answer(request)
+			if response == nil {
+				continue
+			}
+			conn.WriteToUDP(response.Bytes(), source)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// startTCPUpstream serves DNS over TCP on address, the address of a UDP upstream, answering with answer
+func startTCPUpstream(t *testing.T, address string, answer func(request *msg.Message) *msg.Message) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal("Failed to bind TCP upstream:", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				for {
+					if _, err := io.ReadFull(conn, length[:]); err != nil {
+						return
+					}
+					packet := make([]byte, binary.BigEndian.Uint16(length[:]))
+					if _, err := io.ReadFull(conn, packet); err != nil {
+						return
+					}
+					request, err := msg.FromBytes(packet)
+					if err != nil {
+						return
+					}
+					response := answer(request).Bytes()
+					binary.BigEndian.PutUint16(length[:], uint16(len(response)))
+					conn.Write(append(length[:], response...))
+				}
+			}()
+		}
+	}()
+}
+
+// answerA answers every A question with the same A record, other questions get no data
+func answerA(ip net.IP) func(request *msg.Message) *msg.Message {
+	return func(request *msg.Message) *msg.Message {
+		response := newResponse(request)
+		response.Header.RecursionAvailable = true
+		for _, question := range request.Questions {
+			response.Questions = append(response.Questions, question)
+			if question.Type != msg.TypeA {
+				continue
+			}
+			response.Answers = append(response.Answers, &msg.Answer{
+				Name:  question.Name,
+				Type:  question.Type,
+				Class: question.Class,
+				TTL:   60,
+				Data:  &msg.A{IP: ip},
+			})
+		}
+		return response
+	}
+}
+
+// closedAddress returns a local address nothing listens on
+func closedAddress(t *testing.T) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("Failed to bind:", err)
+	}
+	address := conn.LocalAddr().String()
+	conn.Close()
+	return address
+}
+
+func newTestUpstreams(t *testing.T, addresses ...string) []*Upstream {
+	upstreams := make([]*Upstream, len(addresses))
+	for i, address := range addresses {
+		upstream, err := NewUpstream(address)
+		if err != nil {
+			t.Fatal("Failed to create upstream:", err)
+		}
+		upstreams[i] = upstream
+	}
+	return upstreams
+}
+
+func addresses(upstreams []*Upstream) []string {
+	result := make([]string, len(upstreams))
+	for i, upstream := range upstreams {
+		result[i] = upstream.Address
+	}
+	return result
+}
+
+func TestUpstreamPoolStrategies(t *testing.T) {
+	upstreams := newTestUpstreams(t, "10.0.0.1:53", "10.0.0.2:53", "10.0.0.3:53")
+
+	sequential, _ := newUpstreamPool(upstreams, StrategySequential)
+	if order := addresses(sequential.candidates()); order[0] != "10.0.0.1:53" || order[2] != "10.0.0.3:53" {
+		t.Errorf("Expected configured order, got %v", order)
+	}
+
+	roundRobin, _ := newUpstreamPool(upstreams, StrategyRoundRobin)
+	roundRobin.candidates()
+	if order := addresses(roundRobin.candidates()); order[0] != "10.0.0.2:53" || order[2] != "10.0.0.1:53" {
+		t.Errorf("Expected rotated order, got %v", order)
+	}
+
+	upstreams[0].success(30 * time.Millisecond)
+	upstreams[1].success(10 * time.Millisecond)
+	upstreams[2].success(20 * time.Millisecond)
+	fastest, _ := newUpstreamPool(upstreams, StrategyFastest)
+	if order := addresses(fastest.candidates()); order[0] != "10.0.0.2:53" || order[1] != "10.0.0.3:53" {
+		t.Errorf("Expected order by RTT, got %v", order)
+	}
+
+	for i := 0; i < maxUpstreamFailures; i++ {
+		upstreams[1].failure()
+	}
+	if order := addresses(fastest.candidates()); order[2] != "10.0.0.2:53" {
+		t.Errorf("Expected down upstream last, got %v", order)
+	}
+
+	if _, err := newUpstreamPool(upstreams, "weighted"); err == nil {
+		t.Error("Expected unknown strategy to fail")
+	}
+}
+
+func TestForwardingResolverFailover(t *testing.T) {
+	closed := closedAddress(t)
+	working := startUpstream(t, answerA(net.IPv4(10, 0, 0, 1)))
+	resolver, err := NewForwardingResolver([]string{closed, working}, ForwardingOptions{Strategy: StrategySequential})
+	if err != nil {
+		t.Fatal("Failed to create resolver:", err)
+	}
+
+	for i := 0; i < maxUpstreamFailures; i++ {
+		response, err := resolver.Resolve(context.Background(), newQuery(
+			&msg.Question{Name: "abc.test", Type: msg.TypeA, Class: msg.ClassINET},
+		))
+		if err != nil {
+			t.Fatal("Failed to resolve:", err)
+		}
+		if len(response.Answers) != 1 {
+			t.Fatalf("Expected the second upstream to answer, got %v", response.Answers)
+		}
+	}
+
+	upstreams := resolver.Upstreams()
+	if !upstreams[0].IsDown() || upstreams[1].IsDown() {
+		t.Error("Expected only the failing upstream to be marked down")
+	}
+	if upstreams[1].RTT() == 0 {
+		t.Error("Expected the RTT of the working upstream to be tracked")
+	}
+}
+
+func TestUpstreamProbe(t *testing.T) {
+	working := startUpstream(t, answerA(net.IPv4(10, 0, 0, 1)))
+	upstreams := newTestUpstreams(t, working)
+	pool, _ := newUpstreamPool(upstreams, StrategySequential)
+
+	for i := 0; i < maxUpstreamFailures; i++ {
+		upstreams[0].failure()
+	}
+	// Pretend the backoff is over
+	upstreams[0].mutex.Lock()
+	upstreams[0].downUntil = time.Now()
+	upstreams[0].mutex.Unlock()
+
+	pool.candidates()
+	deadline := time.Now().Add(probeTimeout)
+	for upstreams[0].IsDown() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if upstreams[0].IsDown() {
+		t.Error("Expected a successful probe to return the upstream to rotation")
+	}
+}
+
+func TestUpstreamSuccessRecovers(t *testing.T) {
+	upstream := newTestUpstreams(t, "10.0.0.1:53")[0]
+	down := func() {
+		for i := 0; i < maxUpstreamFailures; i++ {
+			upstream.failure()
+		}
+	}
+
+	down()
+	// A failed probe doubles the backoff
+	upstream.probeResult(false, 0)
+	upstream.success(10 * time.Millisecond)
+	if upstream.IsDown() {
+		t.Fatal("Expected an answered query to return the upstream to rotation")
+	}
+
+	// A probe started before the answer does not take the upstream down again
+	upstream.probeResult(false, 0)
+	if upstream.IsDown() {
+		t.Error("Expected a failed probe not to mark a recovered upstream down")
+	}
+
+	down()
+	upstream.mutex.Lock()
+	backoff := upstream.backoff
+	upstream.mutex.Unlock()
+	if backoff != minUpstreamBackoff {
+		t.Errorf("Expected the backoff to start over at %s, got %s", minUpstreamBackoff, backoff)
+	}
+}
@@ -0,0 +1,49 @@
+package zone
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned while parsing a master file.
+// They are wrapped in a ParseError carrying the line where parsing failed,
+// so callers should compare them using errors.Is.
+var (
+	ErrUnbalancedParentheses = errors.New("unbalanced parentheses")
+	ErrUnterminatedString    = errors.New("unterminated quoted string")
+	ErrInvalidEscape         = errors.New("invalid escape sequence")
+	ErrUnknownDirective      = errors.New("unknown directive")
+	ErrInvalidDirective      = errors.New("invalid directive")
+	ErrMissingOwner          = errors.New("record without owner name")
+	ErrInvalidName           = errors.New("invalid name")
+	ErrMissingOrigin         = errors.New("relative name without origin")
+	ErrMissingTTL            = errors.New("record without TTL and no $TTL")
+	ErrInvalidTTL            = errors.New("invalid TTL")
+	ErrUnsupportedClass      = errors.New("unsupported class")
+	ErrUnknownType           = errors.New("unknown record type")
+	ErrInvalidRData          = errors.New("invalid record data")
+	ErrIncludeDepth          = errors.New("$INCLUDE nested too deeply")
+)
+
+// ParseError is an error that occurred while parsing a master file
+type ParseError struct {
+	// File is the file being parsed, empty for data not read from a file
+	File string
+	// Line is the line where the failing entry starts
+	Line int
+	// Err is one of the parsing errors defined in this package, possibly wrapped with details
+	Err error
+}
+
+// Error returns a string representation of the ParseError
+func (e *ParseError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Err)
+}
+
+// Unwrap returns the underlying parsing error
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,162 @@
+package zone
+
+import "strconv"
+
+// token is a word or a quoted string of a master file, with its escapes decoded
+type token struct {
+	text   string
+	quoted bool
+}
+
+// entry is a logical line of a master file, parentheses may make it span several lines
+type entry struct {
+	// line is the line number the entry starts on
+	line   int
+	tokens []token
+	// indented is set when the entry starts with a blank, meaning the owner is the previous one
+	indented bool
+}
+
+// lex splits master file data into entries, dropping comments and empty lines
+// https://www.rfc-editor.org/rfc/rfc1035#section-5.1
+func lex(data []byte) ([]entry, error) {
+	var entries []entry
+	line := 1
+	current := entry{line: line}
+	depth := 0
+	atLineStart := true
+
+	flush := func() {
+		if len(current.tokens) > 0 {
+			entries = append(entries, current)
+		}
+		current = entry{line: line}
+	}
+
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch c {
+		case '\n':
+			line++
+			i++
+			atLineStart = true
+			if depth == 0 {
+				flush()
+			}
+			continue
+		case ' ', '\t', '\r':
+			if atLineStart && depth == 0 && len(current.tokens) == 0 {
+				current.indented = true
+			}
+			i++
+		case ';':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case '(':
+			depth++
+			i++
+		case ')':
+			if depth == 0 {
+				return nil, &ParseError{Line: line, Err: ErrUnbalancedParentheses}
+			}
+			depth--
+			i++
+		case '"':
+			text, next, err := lexQuoted(data, i+1)
+			if err != nil {
+				return nil, &ParseError{Line: line, Err: err}
+			}
+			current.tokens = append(current.tokens, token{text: text, quoted: true})
+			i = next
+		default:
+			text, next, err := lexWord(data, i)
+			if err != nil {
+				return nil, &ParseError{Line: line, Err: err}
+			}
+			current.tokens = append(current.tokens, token{text: text})
+			i = next
+		}
+		atLineStart = false
+	}
+	if depth != 0 {
+		return nil, &ParseError{Line: current.line, Err: ErrUnbalancedParentheses}
+	}
+	flush()
+	return entries, nil
+}
+
+// lexQuoted reads a quoted string starting after its opening quote,
+// returning its text and the position after the closing quote
+func lexQuoted(data []byte, i int) (string, int, error) {
+	var text []byte
+	for i < len(data) {
+		switch data[i] {
+		case '"':
+			return string(text), i + 1, nil
+		case '\n':
+			return "", i, ErrUnterminatedString
+		case '\\':
+			c, next, err := unescape(data, i)
+			if err != nil {
+				return "", i, err
+			}
+			text = append(text, c)
+			i = next
+		default:
+			text = append(text, data[i])
+			i++
+		}
+	}
+	return "", i, ErrUnterminatedString
+}
+
+// lexWord reads a word up to the next blank or special character,
+// returning its text and the position after it
+func lexWord(data []byte, i int) (string, int, error) {
+	start := i
+	var text []byte
+	for i < len(data) {
+		switch data[i] {
+		case ' ', '\t', '\r', '\n', ';', '(', ')', '"':
+			return word(data[start:i], text), i, nil
+		case '\\':
+			c, next, err := unescape(data, i)
+			if err != nil {
+				return "", i, err
+			}
+			text = append(text, c)
+			i = next
+		default:
+			text = append(text, data[i])
+			i++
+		}
+	}
+	return word(data[start:i], text), i, nil
+}
+
+// word returns the decoded text of a word, except for the \# marker of RFC 3597 generic RDATA
+func word(raw, text []byte) string {
+	if string(raw) == `\#` {
+		return `\#`
+	}
+	return string(text)
+}
+
+// unescape decodes \X and \DDD at data[i], returning the character and the position after the escape
+func unescape(data []byte, i int) (byte, int, error) {
+	if i+1 >= len(data) || data[i+1] == '\n' {
+		return 0, i, ErrInvalidEscape
+	}
+	if data[i+1] < '0' || data[i+1] > '9' {
+		return data[i+1], i + 2, nil
+	}
+	if i+4 > len(data) {
+		return 0, i, ErrInvalidEscape
+	}
+	value, err := strconv.ParseUint(string(data[i+1:i+4]), 10, 8)
+	if err != nil {
+		return 0, i, ErrInvalidEscape
+	}
+	return byte(value), i + 4, nil
+}
@@ -0,0 +1,214 @@
+package zone
+
+import (
+	"encoding/hex"
+	"fmt"
+	msg "github.com/rodweb/dns/internal/message"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// parseRData reads the RDATA fields of a record of the given type.
+// Any type may use the generic \# format of RFC 3597, which is the only format of the types without an implementation.
+func parseRData(recordType uint16, tokens []token, origin string) (msg.RData, error) {
+	if len(tokens) > 0 && !tokens[0].quoted && tokens[0].text == `\#` {
+		return parseGeneric(recordType, tokens[1:])
+	}
+
+	f := &fields{tokens: tokens, origin: origin}
+	var data msg.RData
+	switch recordType {
+	case msg.TypeA:
+		a, err := msg.NewA(f.ip())
+		if err != nil {
+			f.fail("%s", err)
+		}
+		data = a
+	case msg.TypeAAAA:
+		aaaa, err := msg.NewAAAA(f.ip())
+		if err != nil {
+			f.fail("%s", err)
+		}
+		data = aaaa
+	case msg.TypeNS:
+		data = &msg.NS{Host: f.name()}
+	case msg.TypeCNAME:
+		data = &msg.CNAME{Target: f.name()}
+	case msg.TypePTR:
+		data = &msg.PTR{Host: f.name()}
+	case msg.TypeMX:
+		data = &msg.MX{Preference: f.uint16(), Exchange: f.name()}
+	case msg.TypeSOA:
+		// The timers may use TTL units, the serial may not
+		data = &msg.SOA{
+			MName:   f.name(),
+			RName:   f.name(),
+			Serial:  f.uint32(),
+			Refresh: f.ttl(),
+			Retry:   f.ttl(),
+			Expire:  f.ttl(),
+			Minimum: f.ttl(),
+		}
+	case msg.TypeTXT:
+		txt := &msg.TXT{}
+		for f.more() {
+			txt.Texts = append(txt.Texts, f.text())
+		}
+		if len(txt.Texts) == 0 {
+			f.fail("missing text")
+		}
+		data = txt
+	case msg.TypeSRV:
+		data = &msg.SRV{Priority: f.uint16(), Weight: f.uint16(), Port: f.uint16(), Target: f.name()}
+	case msg.TypeCAA:
+		caa := &msg.CAA{Flags: f.uint8(), Tag: f.text(), Value: f.text()}
+		if f.err == nil && !isCAATag(caa.Tag) {
+			f.fail("invalid CAA tag %q", caa.Tag)
+		}
+		data = caa
+	default:
+		return nil, fmt.Errorf(`%w: type %s only supports the \# format`, ErrInvalidRData, msg.TypeToString(recordType))
+	}
+
+	if f.err == nil && f.more() {
+		f.fail("unexpected %q", f.tokens[0].text)
+	}
+	if f.err != nil {
+		return nil, fmt.Errorf("%w for %s: %s", ErrInvalidRData, msg.TypeToString(recordType), f.err)
+	}
+	return data, nil
+}
+
+// parseGeneric reads RDATA in the \# format: its length followed by the data in hexadecimal, possibly split in words
+// https://www.rfc-editor.org/rfc/rfc3597#section-5
+func parseGeneric(recordType uint16, tokens []token) (msg.RData, error) {
+	if name := msg.TypeToString(recordType); !strings.HasPrefix(name, "TYPE") {
+		// Typed data is needed for the names inside known records, such as the target of a CNAME
+		return nil, fmt.Errorf(`%w: the \# format is not supported for %s`, ErrInvalidRData, name)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf(`%w: \# without length`, ErrInvalidRData)
+	}
+	length, err := strconv.ParseUint(tokens[0].text, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf(`%w: invalid \# length %q`, ErrInvalidRData, tokens[0].text)
+	}
+	var digits strings.Builder
+	for _, t := range tokens[1:] {
+		digits.WriteString(t.text)
+	}
+	data, err := hex.DecodeString(digits.String())
+	if err != nil {
+		return nil, fmt.Errorf(`%w: invalid \# data: %s`, ErrInvalidRData, err)
+	}
+	if len(data) != int(length) {
+		return nil, fmt.Errorf(`%w: \# data is %d octets long, not %d`, ErrInvalidRData, len(data), length)
+	}
+	return &msg.Unknown{RRType: recordType, Data: data}, nil
+}
+
+// fields reads the RDATA fields in order. The first error is kept and later reads return zero values,
+// so that a record can be read field by field and checked once.
+type fields struct {
+	tokens []token
+	origin string
+	err    error
+}
+
+func (f *fields) fail(format string, args ...interface{}) {
+	if f.err == nil {
+		f.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (f *fields) more() bool {
+	return len(f.tokens) > 0
+}
+
+// next returns the next field, quoted or not
+func (f *fields) next() (token, bool) {
+	if f.err != nil {
+		return token{}, false
+	}
+	if len(f.tokens) == 0 {
+		f.fail("missing field")
+		return token{}, false
+	}
+	t := f.tokens[0]
+	f.tokens = f.tokens[1:]
+	return t, true
+}
+
+func (f *fields) text() string {
+	t, _ := f.next()
+	return t.text
+}
+
+func (f *fields) name() string {
+	t, ok := f.next()
+	if !ok {
+		return ""
+	}
+	name, err := qualify(t.text, f.origin)
+	if err != nil {
+		f.fail("%s", err)
+	}
+	return name
+}
+
+func (f *fields) ip() net.IP {
+	t, ok := f.next()
+	if !ok {
+		return nil
+	}
+	ip := net.ParseIP(t.text)
+	if ip == nil {
+		f.fail("invalid address %q", t.text)
+	}
+	return ip
+}
+
+func (f *fields) number(bits int) uint64 {
+	t, ok := f.next()
+	if !ok {
+		return 0
+	}
+	value, err := strconv.ParseUint(t.text, 10, bits)
+	if err != nil {
+		f.fail("invalid %d bit number %q", bits, t.text)
+	}
+	return value
+}
+
+func (f *fields) uint8() uint8 { return uint8(f.number(8)) }
+
+func (f *fields) uint16() uint16 { return uint16(f.number(16)) }
+
+func (f *fields) uint32() uint32 { return uint32(f.number(32)) }
+
+func (f *fields) ttl() uint32 {
+	t, ok := f.next()
+	if !ok {
+		return 0
+	}
+	ttl, err := parseTTL(t.text)
+	if err != nil {
+		f.fail("%s", err)
+	}
+	return ttl
+}
+
+// isCAATag reports whether a CAA property tag is made of letters and digits only
+// https://www.rfc-editor.org/rfc/rfc8659#section-4.1
+func isCAATag(tag string) bool {
+	if tag == "" {
+		return false
+	}
+	for _, c := range tag {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,328 @@
+// Package zone reads DNS data in the master file format of RFC 1035, as used by BIND zone files.
+// https://www.rfc-editor.org/rfc/rfc1035#section-5
+package zone
+
+import (
+	"fmt"
+	msg "github.com/rodweb/dns/internal/message"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxIncludeDepth is how deep $INCLUDE directives may nest, so that a file including itself fails
+const maxIncludeDepth = 8
+
+// maxTTL is the largest TTL allowed, RFC 2181 keeps the top bit clear
+// https://www.rfc-editor.org/rfc/rfc2181#section-8
+const maxTTL = 1<<31 - 1
+
+// Load reads the records of a master file.
+// origin is the name relative names are completed with until a $ORIGIN directive, "." for the root.
+// Without an origin, relative names fail with ErrMissingOrigin as they do with BIND.
+// Files named by $INCLUDE are looked up relative to the directory of the including file.
+func Load(filename string, origin string) ([]*msg.Answer, error) {
+	p := &parser{}
+	err := p.loadFile(filename, originOf(origin), 0)
+	if err != nil {
+		return nil, err
+	}
+	return p.records, nil
+}
+
+// Parse reads the records of master file data, with $INCLUDE relative to the working directory
+func Parse(r io.Reader, origin string) ([]*msg.Answer, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{}
+	err = p.parse(data, "", originOf(origin), 0)
+	if err != nil {
+		return nil, err
+	}
+	return p.records, nil
+}
+
+// parser holds the state shared by a master file and the files it includes
+type parser struct {
+	records []*msg.Answer
+	// lastTTL is the TTL of the previous record, used when a record has none and there is no $TTL
+	lastTTL    uint32
+	hasLastTTL bool
+}
+
+func (p *parser) loadFile(filename string, origin string, depth int) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return p.parse(data, filename, origin, depth)
+}
+
+// parse reads the entries of a file. The origin, the default TTL and the previous owner
+// are local to the file, an included file does not change them for the including one.
+func (p *parser) parse(data []byte, filename string, origin string, depth int) error {
+	entries, err := lex(data)
+	if err != nil {
+		err.(*ParseError).File = filename
+		return err
+	}
+
+	var owner string
+	var hasOwner bool
+	var defaultTTL uint32
+	var hasDefaultTTL bool
+	for _, e := range entries {
+		fail := func(err error) error {
+			return &ParseError{File: filename, Line: e.line, Err: err}
+		}
+		first := e.tokens[0]
+
+		if !e.indented && !first.quoted && strings.HasPrefix(first.text, "$") {
+			args := e.tokens[1:]
+			switch strings.ToUpper(first.text) {
+			case "$ORIGIN":
+				if len(args) != 1 {
+					return fail(fmt.Errorf("%w: $ORIGIN takes a name", ErrInvalidDirective))
+				}
+				name, err := qualify(args[0].text, origin)
+				if err != nil {
+					return fail(err)
+				}
+				origin = absolute(name)
+			case "$TTL":
+				if len(args) != 1 {
+					return fail(fmt.Errorf("%w: $TTL takes a TTL", ErrInvalidDirective))
+				}
+				defaultTTL, err = parseTTL(args[0].text)
+				if err != nil {
+					return fail(err)
+				}
+				hasDefaultTTL = true
+			case "$INCLUDE":
+				if len(args) != 1 && len(args) != 2 {
+					return fail(fmt.Errorf("%w: $INCLUDE takes a file and an optional origin", ErrInvalidDirective))
+				}
+				if depth >= maxIncludeDepth {
+					return fail(ErrIncludeDepth)
+				}
+				includeOrigin := origin
+				if len(args) == 2 {
+					name, err := qualify(args[1].text, origin)
+					if err != nil {
+						return fail(err)
+					}
+					includeOrigin = absolute(name)
+				}
+				path := args[0].text
+				if !filepath.IsAbs(path) && filename != "" {
+					path = filepath.Join(filepath.Dir(filename), path)
+				}
+				err = p.loadFile(path, includeOrigin, depth+1)
+				if err != nil {
+					if _, ok := err.(*ParseError); ok {
+						return err
+					}
+					return fail(err)
+				}
+			default:
+				return fail(fmt.Errorf("%w %s", ErrUnknownDirective, first.text))
+			}
+			continue
+		}
+
+		tokens := e.tokens
+		if !e.indented {
+			owner, err = qualify(first.text, origin)
+			if err != nil {
+				return fail(err)
+			}
+			hasOwner = true
+			tokens = tokens[1:]
+		}
+		if !hasOwner {
+			return fail(ErrMissingOwner)
+		}
+
+		record, err := p.parseRecord(tokens, owner, origin, defaultTTL, hasDefaultTTL)
+		if err != nil {
+			return fail(err)
+		}
+		p.records = append(p.records, record)
+	}
+	return nil
+}
+
+// parseRecord reads the fields after the owner name: [TTL] [class] type RDATA, TTL and class in any order
+func (p *parser) parseRecord(tokens []token, owner, origin string, defaultTTL uint32, hasDefaultTTL bool) (*msg.Answer, error) {
+	var ttl uint32
+	var hasTTL, hasClass bool
+	for len(tokens) > 0 && !tokens[0].quoted {
+		text := tokens[0].text
+		if !hasClass && isClass(text) {
+			if !strings.EqualFold(text, "IN") {
+				return nil, fmt.Errorf("%w %s", ErrUnsupportedClass, text)
+			}
+			hasClass = true
+		} else if !hasTTL && text != "" && text[0] >= '0' && text[0] <= '9' {
+			var err error
+			ttl, err = parseTTL(text)
+			if err != nil {
+				return nil, err
+			}
+			hasTTL = true
+		} else {
+			break
+		}
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%w: missing type", ErrUnknownType)
+	}
+
+	recordType, ok := msg.StringToType(tokens[0].text)
+	if !ok || recordType == msg.TypeOPT {
+		return nil, fmt.Errorf("%w %s", ErrUnknownType, tokens[0].text)
+	}
+	data, err := parseRData(recordType, tokens[1:], origin)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case hasTTL:
+	case hasDefaultTTL:
+		ttl = defaultTTL
+	case p.hasLastTTL:
+		ttl = p.lastTTL
+	default:
+		return nil, ErrMissingTTL
+	}
+	p.lastTTL, p.hasLastTTL = ttl, true
+
+	return &msg.Answer{
+		Name:  owner,
+		Type:  recordType,
+		Class: msg.ClassINET,
+		TTL:   ttl,
+		Data:  data,
+	}, nil
+}
+
+// isClass reports whether a field is a class mnemonic rather than a record type
+func isClass(text string) bool {
+	switch strings.ToUpper(text) {
+	case "IN", "CS", "CH", "HS":
+		return true
+	}
+	return false
+}
+
+// parseTTL reads a TTL in seconds, or with the BIND units such as "1h30m"
+func parseTTL(text string) (uint32, error) {
+	if value, err := strconv.ParseUint(text, 10, 32); err == nil {
+		if value > maxTTL {
+			return 0, fmt.Errorf("%w %s", ErrInvalidTTL, text)
+		}
+		return uint32(value), nil
+	}
+
+	var total, number uint64
+	digits := false
+	for _, c := range strings.ToLower(text) {
+		if c >= '0' && c <= '9' {
+			number = number*10 + uint64(c-'0')
+			digits = true
+			if number > maxTTL {
+				return 0, fmt.Errorf("%w %s", ErrInvalidTTL, text)
+			}
+			continue
+		}
+		unit, ok := ttlUnits[c]
+		if !ok || !digits {
+			return 0, fmt.Errorf("%w %s", ErrInvalidTTL, text)
+		}
+		total += number * unit
+		if total > maxTTL {
+			return 0, fmt.Errorf("%w %s", ErrInvalidTTL, text)
+		}
+		number, digits = 0, false
+	}
+	// A trailing number without unit is in seconds
+	total += number
+	if total > maxTTL {
+		return 0, fmt.Errorf("%w %s", ErrInvalidTTL, text)
+	}
+	return uint32(total), nil
+}
+
+var ttlUnits = map[rune]uint64{
+	's': 1,
+	'm': 60,
+	'h': 60 * 60,
+	'd': 24 * 60 * 60,
+	'w': 7 * 24 * 60 * 60,
+}
+
+// qualify returns a name of the file as an absolute name without the trailing dot.
+// "@" is the origin, names without a trailing dot are relative to it.
+// origin is an absolute name with its trailing dot, empty when there is none.
+// Names that do not fit the wire format fail with ErrInvalidName.
+func qualify(name, origin string) (string, error) {
+	switch {
+	case strings.HasSuffix(name, "."):
+		name = canonical(name)
+	case origin == "":
+		return "", fmt.Errorf("%w: %s", ErrMissingOrigin, name)
+	case name == "@":
+		name = canonical(origin)
+	case origin == ".":
+		// name is relative to the root
+	default:
+		name = name + "." + canonical(origin)
+	}
+	return name, checkName(name)
+}
+
+// originOf returns the origin given to Load or Parse with its trailing dot, empty when there is none
+func originOf(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	return absolute(canonical(origin))
+}
+
+// absolute returns a name without its trailing dot as an absolute name, the root being "."
+func absolute(name string) string {
+	return name + "."
+}
+
+// checkName checks that a name fits the wire format
+func checkName(name string) error {
+	if err := msg.CheckName(name); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidName, err)
+	}
+	return nil
+}
+
+// canonical returns an absolute name without its trailing dot, the root being empty
+func canonical(name string) string {
+	return strings.TrimSuffix(name, ".")
+}
+
+// ParseRData reads the RDATA of a record of the given type from its presentation format,
+// the inverse of msg.RData.String. Relative names are completed with origin, the root when empty.
+func ParseRData(recordType uint16, text string, origin string) (msg.RData, error) {
+	entries, err := lex([]byte(text))
+	if err != nil {
+		return nil, err.(*ParseError).Err
+	}
+	var tokens []token
+	for _, e := range entries {
+		tokens = append(tokens, e.tokens...)
+	}
+	return parseRData(recordType, tokens, absolute(canonical(origin)))
+}
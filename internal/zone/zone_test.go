@@ -0,0 +1,208 @@
+package zone
+
+import (
+	"errors"
+	msg "github.com/rodweb/dns/internal/message"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const exampleZone = `
+$ORIGIN example.test.
+$TTL 1h
+@	IN	SOA	ns1 hostmaster (
+		2024010101 ; serial
+		2h         ; refresh
+		15m        ; retry
+		2w         ; expire
+		300 )      ; minimum
+	IN	NS	ns1
+	IN	NS	ns.other.test.
+	IN	MX	10 mail
+ns1	300	A	192.0.2.1
+www	IN 60	A	192.0.2.2
+	AAAA	2001:db8::2
+alias	CNAME	www
+txt	TXT	"hello world" "quote \" and \\backslash" plain
+caa	CAA	0 issue "ca.test"
+_sip._tcp	SRV	10 20 5060 www
+2.2.0.192.in-addr.arpa.	PTR	www
+unknown	TYPE65534	\# 4 0a00 0001
+$ORIGIN sub
+host	A	192.0.2.3
+`
+
+func TestParse(t *testing.T) {
+	records, err := Parse(strings.NewReader(exampleZone), "")
+	if err != nil {
+		t.Fatal("Failed to parse:", err)
+	}
+
+	expected := []struct {
+		name   string
+		rrType uint16
+		ttl    uint32
+		data   string
+	}{
+		{"example.test", msg.TypeSOA, 3600, "ns1.example.test. hostmaster.example.test. 2024010101 7200 900 1209600 300"},
+		{"example.test", msg.TypeNS, 3600, "ns1.example.test."},
+		{"example.test", msg.TypeNS, 3600, "ns.other.test."},
+		{"example.test", msg.TypeMX, 3600, "10 mail.example.test."},
+		{"ns1.example.test", msg.TypeA, 300, "192.0.2.1"},
+		{"www.example.test", msg.TypeA, 60, "192.0.2.2"},
+		{"www.example.test", msg.TypeAAAA, 3600, "2001:db8::2"},
+		{"alias.example.test", msg.TypeCNAME, 3600, "www.example.test."},
+		{"txt.example.test", msg.TypeTXT, 3600, `"hello world" "quote \" and \\backslash" "plain"`},
+		{"caa.example.test", msg.TypeCAA, 3600, `0 issue "ca.test"`},
+		{"_sip._tcp.example.test", msg.TypeSRV, 3600, "10 20 5060 www.example.test."},
+		{"2.2.0.192.in-addr.arpa", msg.TypePTR, 3600, "www.example.test."},
+		{"unknown.example.test", 65534, 3600, `\# 4 0a000001`},
+		{"host.sub.example.test", msg.TypeA, 3600, "192.0.2.3"},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d records, got %d: %v", len(expected), len(records), records)
+	}
+	for i, e := range expected {
+		record := records[i]
+		if record.Name != e.name || record.Type != e.rrType || record.Class != msg.ClassINET ||
+			record.TTL != e.ttl || record.Data.String() != e.data {
+			t.Errorf("Expected %s %d %s %s, got %s %d %s %s",
+				e.name, e.ttl, msg.TypeToString(e.rrType), e.data,
+				record.Name, record.TTL, msg.TypeToString(record.Type), record.Data)
+		}
+	}
+}
+
+func TestParseDefaultTTL(t *testing.T) {
+	// Without $TTL, a record without TTL takes the TTL of the previous one
+	records, err := Parse(strings.NewReader("a.test. 120 A 192.0.2.1\nb.test. A 192.0.2.2\n"), "")
+	if err != nil {
+		t.Fatal("Failed to parse:", err)
+	}
+	if records[1].TTL != 120 {
+		t.Errorf("Expected TTL 120, got %d", records[1].TTL)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  error
+		line int
+	}{
+		{"unbalanced", "a.test. 60 SOA ns host ( 1 2 3 4 5\n", ErrUnbalancedParentheses, 1},
+		{"closing", "a.test. 60 A 192.0.2.1 )\n", ErrUnbalancedParentheses, 1},
+		{"unterminated", "a.test. 60 TXT \"text\n", ErrUnterminatedString, 1},
+		{"directive", "$GENERATE 1-2 a A 192.0.2.$\n", ErrUnknownDirective, 1},
+		{"no owner", "\n  60 A 192.0.2.1\n", ErrMissingOwner, 2},
+		{"no TTL", "a.test. A 192.0.2.1\n", ErrMissingTTL, 1},
+		{"bad TTL", "a.test. 1x A 192.0.2.1\n", ErrInvalidTTL, 1},
+		{"class", "a.test. 60 CH A 192.0.2.1\n", ErrUnsupportedClass, 1},
+		{"type", "a.test. 60 NOPE 192.0.2.1\n", ErrUnknownType, 1},
+		{"IPv6 as A", "$TTL 60\n\na.test. A 2001:db8::1\n", ErrInvalidRData, 3},
+		{"IPv4 as AAAA", "a.test. 60 AAAA 192.0.2.1\n", ErrInvalidRData, 1},
+		{"missing field", "a.test. 60 MX 10\n", ErrInvalidRData, 1},
+		{"extra field", "a.test. 60 CNAME b.test. c.test.\n", ErrInvalidRData, 1},
+		{"generic length", "a.test. 60 TYPE65534 \\# 3 0a00\n", ErrInvalidRData, 1},
+		{"generic known type", "a.test. 60 A \\# 4 c0000201\n", ErrInvalidRData, 1},
+		{"long label", "$TTL 60\n" + strings.Repeat("a", 64) + ".test. A 192.0.2.1\n", ErrInvalidName, 2},
+		{"long name", strings.Repeat("abcdefg.", 32) + " 60 A 192.0.2.1\n", ErrInvalidName, 1},
+		{"long relative name", "$ORIGIN " + strings.Repeat("abcdefg.", 31) + "\nlonghost 60 A 192.0.2.1\n", ErrInvalidName, 2},
+		{"long origin", "$ORIGIN " + strings.Repeat("a", 64) + ".\n", ErrInvalidName, 1},
+		{"empty label", "a..test. 60 A 192.0.2.1\n", ErrInvalidName, 1},
+		{"long target", "a.test. 60 CNAME " + strings.Repeat("a", 64) + ".test.\n", ErrInvalidRData, 1},
+		{"relative owner", "www 60 A 192.0.2.1\n", ErrMissingOrigin, 1},
+		{"origin owner", "@ 60 A 192.0.2.1\n", ErrMissingOrigin, 1},
+		{"relative origin", "$ORIGIN sub\n", ErrMissingOrigin, 1},
+		{"relative target", "a.test. 60 CNAME www\n", ErrInvalidRData, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(test.data), "")
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Expected %v, got %v", test.err, err)
+			}
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) || parseErr.Line != test.line {
+				t.Errorf("Expected the error on line %d, got %v", test.line, err)
+			}
+		})
+	}
+}
+
+func TestParseRootOrigin(t *testing.T) {
+	for _, test := range []struct {
+		data   string
+		origin string
+	}{
+		{"www 60 CNAME target\n", "."},
+		{"$ORIGIN .\nwww 60 CNAME target\n", ""},
+	} {
+		records, err := Parse(strings.NewReader(test.data), test.origin)
+		if err != nil {
+			t.Fatal("Failed to parse:", err)
+		}
+		if len(records) != 1 || records[0].Name != "www" || records[0].Data.String() != "target." {
+			t.Errorf("Expected www relative to the root, got %v", records)
+		}
+	}
+}
+
+func TestLoadInclude(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal("Failed to write zone:", err)
+		}
+		return path
+	}
+	write("hosts.zone", "$TTL 30\nhost A 192.0.2.1\n")
+	path := write("main.zone", "$TTL 60\n$INCLUDE hosts.zone sub\nwww A 192.0.2.2\n")
+	write("self.zone", "$INCLUDE self.zone\n")
+
+	records, err := Load(path, "example.test")
+	if err != nil {
+		t.Fatal("Failed to load:", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %v", records)
+	}
+	// The origin and TTL of the included file do not leak into the including one
+	if records[0].Name != "host.sub.example.test" || records[0].TTL != 30 {
+		t.Errorf("Expected host.sub.example.test with TTL 30, got %s with TTL %d", records[0].Name, records[0].TTL)
+	}
+	if records[1].Name != "www.example.test" || records[1].TTL != 60 {
+		t.Errorf("Expected www.example.test with TTL 60, got %s with TTL %d", records[1].Name, records[1].TTL)
+	}
+
+	if _, err := Load(filepath.Join(dir, "self.zone"), ""); !errors.Is(err, ErrIncludeDepth) {
+		t.Errorf("Expected a file including itself to fail, got %v", err)
+	}
+}
+
+func TestParseRData(t *testing.T) {
+	// The presentation format of every type reads back to the same data
+	records, err := Parse(strings.NewReader(exampleZone), "")
+	if err != nil {
+		t.Fatal("Failed to parse:", err)
+	}
+	for _, record := range records {
+		data, err := ParseRData(record.Type, record.Data.String(), "")
+		if err != nil {
+			t.Errorf("Failed to parse %s %s: %s", msg.TypeToString(record.Type), record.Data, err)
+			continue
+		}
+		if data.String() != record.Data.String() {
+			t.Errorf("Expected %s, got %s", record.Data, data)
+		}
+	}
+
+	data, err := ParseRData(msg.TypeMX, "10 mail", "example.test")
+	if err != nil || data.String() != "10 mail.example.test." {
+		t.Errorf("Expected the exchange relative to the origin, got %v, %v", data, err)
+	}
+}